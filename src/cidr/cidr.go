@@ -0,0 +1,112 @@
+// Package cidr matches addresses against a list of prefixes. The prefixes
+// are merged into sorted, non-overlapping ranges, which is also the form the
+// nftables interval sets are loaded in.
+package cidr
+
+import (
+	"net/netip"
+	"slices"
+)
+
+// Range is an inclusive address range of a single family.
+type Range struct {
+	From, To netip.Addr
+}
+
+// Set is an immutable set of addresses built from prefixes.
+type Set struct {
+	v4, v6 []Range
+}
+
+// New builds a set from prefixes; IPv4-mapped IPv6 prefixes count as IPv4.
+func New(prefixes []netip.Prefix) *Set {
+	var v4, v6 []Range
+	for _, p := range prefixes {
+		if !p.IsValid() {
+			continue
+		}
+		p = Unmap(p).Masked()
+		r := Range{From: p.Addr(), To: lastAddr(p)}
+		if r.From.Is4() {
+			v4 = append(v4, r)
+		} else {
+			v6 = append(v6, r)
+		}
+	}
+	return &Set{v4: merge(v4), v6: merge(v6)}
+}
+
+// Unmap turns an IPv4-mapped IPv6 prefix into the IPv4 prefix it covers.
+func Unmap(p netip.Prefix) netip.Prefix {
+	if p.Addr().Is4In6() && p.Bits() >= 96 {
+		return netip.PrefixFrom(p.Addr().Unmap(), p.Bits()-96)
+	}
+	return p
+}
+
+func lastAddr(p netip.Prefix) netip.Addr {
+	if p.Addr().Is4() {
+		a := p.Addr().As4()
+		for i := p.Bits(); i < 32; i++ {
+			a[i/8] |= 0x80 >> (i % 8)
+		}
+		return netip.AddrFrom4(a)
+	}
+	a := p.Addr().As16()
+	for i := p.Bits(); i < 128; i++ {
+		a[i/8] |= 0x80 >> (i % 8)
+	}
+	return netip.AddrFrom16(a)
+}
+
+// merge sorts the ranges and joins overlapping and adjacent ones.
+func merge(rs []Range) []Range {
+	slices.SortFunc(rs, func(a, b Range) int { return a.From.Compare(b.From) })
+	out := rs[:0]
+	for _, r := range rs {
+		if n := len(out); n > 0 {
+			last := &out[n-1]
+			if next := last.To.Next(); r.From.Compare(last.To) <= 0 || (next.IsValid() && r.From == next) {
+				if r.To.Compare(last.To) > 0 {
+					last.To = r.To
+				}
+				continue
+			}
+		}
+		out = append(out, r)
+	}
+	return out
+}
+
+// Contains reports whether a is inside one of the prefixes.
+func (s *Set) Contains(a netip.Addr) bool {
+	if s == nil {
+		return false
+	}
+	a = a.Unmap()
+	rs := s.v6
+	if a.Is4() {
+		rs = s.v4
+	}
+	i, found := slices.BinarySearchFunc(rs, a, func(r Range, a netip.Addr) int { return r.From.Compare(a) })
+	if found {
+		return true
+	}
+	return i > 0 && a.Compare(rs[i-1].To) <= 0
+}
+
+// Ranges4 returns the merged IPv4 ranges in ascending order.
+func (s *Set) Ranges4() []Range {
+	if s == nil {
+		return nil
+	}
+	return s.v4
+}
+
+// Ranges6 returns the merged IPv6 ranges in ascending order.
+func (s *Set) Ranges6() []Range {
+	if s == nil {
+		return nil
+	}
+	return s.v6
+}
@@ -0,0 +1,132 @@
+package cidr
+
+import (
+	"fmt"
+	"net/netip"
+	"slices"
+	"testing"
+)
+
+func prefixes(ss ...string) []netip.Prefix {
+	var out []netip.Prefix
+	for _, s := range ss {
+		out = append(out, netip.MustParsePrefix(s))
+	}
+	return out
+}
+
+func ranges(rs []Range) []string {
+	var out []string
+	for _, r := range rs {
+		out = append(out, fmt.Sprintf("%s-%s", r.From, r.To))
+	}
+	return out
+}
+
+func TestNew(t *testing.T) {
+	tests := []struct {
+		name   string
+		in     []string
+		v4, v6 []string
+	}{
+		{
+			name: "disjoint, sorted",
+			in:   []string{"198.51.100.0/24", "192.0.2.0/24"},
+			v4:   []string{"192.0.2.0-192.0.2.255", "198.51.100.0-198.51.100.255"},
+		},
+		{
+			name: "overlapping",
+			in:   []string{"10.0.0.0/8", "10.1.0.0/16", "10.255.255.255/32"},
+			v4:   []string{"10.0.0.0-10.255.255.255"},
+		},
+		{
+			name: "partly overlapping",
+			in:   []string{"10.0.0.0/24", "10.0.0.128/25", "10.0.0.0/23"},
+			v4:   []string{"10.0.0.0-10.0.1.255"},
+		},
+		{
+			name: "adjacent",
+			in:   []string{"192.0.2.128/25", "192.0.2.0/25", "192.0.3.0/24"},
+			v4:   []string{"192.0.2.0-192.0.3.255"},
+		},
+		{
+			name: "one address apart",
+			in:   []string{"192.0.2.0/32", "192.0.2.2/32"},
+			v4:   []string{"192.0.2.0-192.0.2.0", "192.0.2.2-192.0.2.2"},
+		},
+		{
+			name: "host bits masked",
+			in:   []string{"192.0.2.77/24"},
+			v4:   []string{"192.0.2.0-192.0.2.255"},
+		},
+		{
+			name: "mixed families",
+			in:   []string{"2001:db8:1::/48", "192.0.2.0/24", "2001:db8::/48"},
+			v4:   []string{"192.0.2.0-192.0.2.255"},
+			v6:   []string{"2001:db8::-2001:db8:1:ffff:ffff:ffff:ffff:ffff"},
+		},
+		{
+			name: "4in6 counts as IPv4",
+			in:   []string{"::ffff:192.0.2.0/120", "192.0.3.0/24", "::ffff:198.51.100.7/128"},
+			v4:   []string{"192.0.2.0-192.0.3.255", "198.51.100.7-198.51.100.7"},
+		},
+		{
+			name: "4in6 shorter than /96 stays IPv6",
+			in:   []string{"::ffff:0:0/95"},
+			v6:   []string{"::fffe:0:0-::ffff:255.255.255.255"},
+		},
+		{
+			name: "whole spaces",
+			in:   []string{"0.0.0.0/0", "255.255.255.255/32", "::/0"},
+			v4:   []string{"0.0.0.0-255.255.255.255"},
+			v6:   []string{"::-ffff:ffff:ffff:ffff:ffff:ffff:ffff:ffff"},
+		},
+		{
+			name: "empty",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := New(prefixes(tt.in...))
+			if got := ranges(s.Ranges4()); !slices.Equal(got, tt.v4) {
+				t.Errorf("v4 %q, want %q", got, tt.v4)
+			}
+			if got := ranges(s.Ranges6()); !slices.Equal(got, tt.v6) {
+				t.Errorf("v6 %q, want %q", got, tt.v6)
+			}
+		})
+	}
+}
+
+func TestContains(t *testing.T) {
+	s := New(append(prefixes("192.0.2.0/24", "198.51.100.64/26", "2001:db8::/32", "::ffff:203.0.113.0/120"), netip.Prefix{}))
+	tests := []struct {
+		addr string
+		want bool
+	}{
+		{"192.0.2.0", true},
+		{"192.0.2.255", true},
+		{"192.0.3.0", false},
+		{"192.0.1.255", false},
+		{"198.51.100.64", true},
+		{"198.51.100.127", true},
+		{"198.51.100.63", false},
+		{"198.51.100.128", false},
+		{"203.0.113.9", true},
+		{"::ffff:192.0.2.9", true},
+		{"::ffff:198.51.100.9", false},
+		{"2001:db8:ffff::1", true},
+		{"2001:db9::", false},
+		{"::", false},
+		{"0.0.0.0", false},
+	}
+	for _, tt := range tests {
+		if got := s.Contains(netip.MustParseAddr(tt.addr)); got != tt.want {
+			t.Errorf("Contains(%s) = %t, want %t", tt.addr, got, tt.want)
+		}
+	}
+	var empty *Set
+	if empty.Contains(netip.MustParseAddr("192.0.2.1")) || empty.Ranges4() != nil || empty.Ranges6() != nil {
+		t.Error("nil set is not empty")
+	}
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/daniellavrushin/b4/config"
+	"github.com/daniellavrushin/b4/iptables"
+	"github.com/daniellavrushin/b4/log"
+	"github.com/daniellavrushin/b4/nftables"
+	"github.com/daniellavrushin/b4/state"
+	"github.com/daniellavrushin/b4/sysctl"
+)
+
+// openState prepares the state directory and reverts the journal of a
+// previous run that was killed before it could clean up. It fails when
+// that run is in fact still alive.
+func openState(cfg *config.Config) error {
+	if err := os.MkdirAll(cfg.StateDir, 0700); err != nil {
+		return err
+	}
+	sysctl.SnapshotPath = state.SysctlSnapshot(cfg.StateDir)
+	j, err := state.Load(cfg.StateDir)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		log.Errorf("state: ignoring unreadable journal: %v", err)
+		return state.Remove(cfg.StateDir)
+	}
+	if j.Alive() {
+		return fmt.Errorf("b4 is already running (pid %d) with state dir %s", j.PID, cfg.StateDir)
+	}
+	log.Infof("state: previous run (pid %d, started %s) did not shut down cleanly, reverting its changes",
+		j.PID, j.Started.Format(time.RFC3339))
+	revertJournal(j)
+	return state.Remove(cfg.StateDir)
+}
+
+// writeJournal records what is about to be installed. It is written before
+// the rules so that a crash halfway through can still be reverted.
+func writeJournal(cfg *config.Config) {
+	j := &state.Journal{
+		PID:           os.Getpid(),
+		BootID:        state.BootID(),
+		StartTicks:    state.StartTicks(os.Getpid()),
+		Started:       time.Now(),
+		QueueStartNum: cfg.QueueStartNum,
+		Threads:       cfg.Threads,
+		Mark:          cfg.Mark,
+	}
+	if !cfg.SkipIpTables {
+		j.Firewall = cfg.Firewall
+		if cfg.Firewall == config.FirewallNFT {
+			j.NFTTable = nftables.Family + " " + nftables.Table
+		} else {
+			m := iptables.Plan(cfg)
+			j.IPTables = &m
+		}
+		j.Sysctls = sysctl.Conntrack
+	}
+	if err := j.Save(cfg.StateDir); err != nil {
+		log.Errorf("state: write journal: %v", err)
+	}
+}
+
+func revertJournal(j *state.Journal) {
+	switch {
+	case j.NFTTable != "":
+		if err := nftables.Remove(); err != nil {
+			log.Errorf("state: %v", err)
+		}
+	case j.IPTables != nil:
+		if err := j.IPTables.Remove(); err != nil {
+			log.Errorf("state: %v", err)
+		}
+	}
+	for _, s := range j.Sysctls {
+		s.RevertBack()
+	}
+}
+
+// teardown removes the firewall rules and the journal on the way out.
+func teardown(cfg *config.Config) {
+	if !cfg.SkipIpTables {
+		if err := clearRules(cfg); err != nil {
+			log.Errorf("failed to clear firewall rules: %v", err)
+		}
+	}
+	if err := state.Remove(cfg.StateDir); err != nil {
+		log.Errorf("state: %v", err)
+	}
+}
+
+// runCleanup implements `b4 cleanup`: revert whatever the journal in the
+// state directory says a dead b4 left behind.
+func runCleanup(args []string) int {
+	cfg := config.DefaultConfig
+	log.Init(os.Stderr, log.Level(cfg.Logging.Level), true)
+	if _, err := cfg.ParseArgs(args); err != nil {
+		log.Flush()
+		return 1
+	}
+	sysctl.SnapshotPath = state.SysctlSnapshot(cfg.StateDir)
+	j, err := state.Load(cfg.StateDir)
+	if errors.Is(err, os.ErrNotExist) {
+		log.Infof("cleanup: no journal in %s, nothing to do", cfg.StateDir)
+		return 0
+	}
+	if err != nil {
+		log.Errorf("cleanup: %v", err)
+		return 1
+	}
+	if j.Alive() {
+		log.Errorf("cleanup: b4 is still running (pid %d); stop it instead", j.PID)
+		return 1
+	}
+	revertJournal(j)
+	if err := state.Remove(cfg.StateDir); err != nil {
+		log.Errorf("cleanup: %v", err)
+		return 1
+	}
+	log.Infof("cleanup: reverted state of pid %d", j.PID)
+	return 0
+}
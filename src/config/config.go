@@ -4,96 +4,470 @@ import (
 	"bufio"
 	"flag"
 	"fmt"
+	"net/netip"
 	"os"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/daniellavrushin/b4/log"
+	"github.com/daniellavrushin/b4/ports"
+	"github.com/daniellavrushin/b4/sni"
+	"github.com/daniellavrushin/b4/tlshello"
 )
 
 type Logging struct {
-	Level      int
-	Instaflush bool
-	Syslog     bool
+	Level      int  `json:"level"`
+	Instaflush bool `json:"instaflush"`
+	Syslog     bool `json:"syslog"`
 }
 
+// Strategy holds the desync knobs applied to matched TCP and QUIC flows.
+type Strategy struct {
+	FragTCP        bool               `json:"frag_tcp"`
+	FragSNIReverse bool               `json:"frag_sni_reverse"`
+	FragMiddleSNI  bool               `json:"frag_middle_sni"`
+	FragSNIPos     int                `json:"frag_sni_pos"`
+	FragPos        tlshello.Positions `json:"frag_pos,omitempty"`
+	FragOrder      string             `json:"frag_order,omitempty"`
+	FakeSeqOffset  int                `json:"fake_seq_offset"`
+	FakeSNISeqLen  int                `json:"fake_sni_seq_len"`
+	FakeType       string             `json:"fake_type"`
+	FakeSNI        string             `json:"fake_sni"`
+	FakePad        bool               `json:"fake_pad"`
+	FakeHelloFile  string             `json:"fake_hello_file,omitempty"`
+	FakeTTL        int                `json:"fake_ttl"`
+	FakeAutoTTL    int                `json:"fake_auto_ttl"`
+	FakeBadSum     bool               `json:"fake_badsum"`
+	FakeMD5Sig     bool               `json:"fake_md5sig"`
+	FakeBadAck     bool               `json:"fake_badack"`
+	FakeTSDecrease int                `json:"fake_ts_decrease"`
+	TLSRecSNI      bool               `json:"tlsrec_sni"`
+	TLSRecPos      int                `json:"tlsrec_pos"`
+	Seg2Delay      time.Duration      `json:"seg2delay"`
+
+	UDPMode           string `json:"udp_mode"`
+	UDPFakeSeqLen     int    `json:"udp_fake_seq_len"`
+	UDPFakeLen        int    `json:"udp_fake_len"`
+	UDPFakingChecksum bool   `json:"udp_faking_checksum"`
+
+	// FakeHello holds the contents of FakeHelloFile.
+	FakeHello []byte `json:"-"`
+}
+
+const (
+	FragOrderForward = "forward"
+	FragOrderReverse = "reverse"
+
+	FakeTypeDefault = "default"
+	FakeTypeRandom  = "random"
+
+	UDPModeFake = "fake"
+	UDPModeDrop = "drop"
+	UDPModeNone = "none"
+
+	FirewallAuto     = "auto"
+	FirewallNFT      = "nft"
+	FirewallIPTables = "iptables"
+)
+
 type Config struct {
-	QueueStartNum  int
-	Mark           uint
-	ConnBytesLimit int
+	QueueStartNum     int       `json:"queue_start_num"`
+	Mark              uint      `json:"mark"`
+	ConnBytesLimit    int       `json:"connbytes_limit"`
+	UDPConnBytesLimit int       `json:"udp_connbytes_limit"`
+	TCPPorts          ports.Set `json:"tcp_ports"`
+	UDPPorts          ports.Set `json:"udp_ports"`
+
+	Interface        string         `json:"interface"`
+	LANIfaces        []string       `json:"lan_ifaces,omitempty"`
+	WANIfaces        []string       `json:"wan_ifaces,omitempty"`
+	OutputOnly       bool           `json:"output_only"`
+	Logging          Logging        `json:"logging"`
+	Strategy         Strategy       `json:"strategy"`
+	SNIDomains       []string       `json:"sni_domains"`
+	SNIDomainsFiles  []string       `json:"sni_domains_files,omitempty"`
+	GeoSiteFile      string         `json:"geosite_file,omitempty"`
+	GeoSite          []string       `json:"geosite,omitempty"`
+	GeoIPFile        string         `json:"geoip_file,omitempty"`
+	GeoIP            []string       `json:"geoip,omitempty"`
+	TargetIPs        []netip.Prefix `json:"target_ips,omitempty"`
+	TargetIPsFiles   []string       `json:"target_ips_files,omitempty"`
+	LearnIPs         bool           `json:"learn_ips"`
+	LearnTTL         int            `json:"learn_ttl"`
+	LearnMax         int            `json:"learn_max"`
+	Profiles         []Profile      `json:"profiles"`
+	Threads          int            `json:"threads"`
+	UseGSO           bool           `json:"gso"`
+	UseConntrack     bool           `json:"conntrack"`
+	SkipIpTables     bool           `json:"skip_iptables"`
+	Firewall         string         `json:"firewall"`
+	WatchInterval    int            `json:"watch_interval"`
+	WatchdogInterval int            `json:"watchdog_interval"`
+	StateDir         string         `json:"state_dir"`
 
-	Interface    string
-	Logging      Logging
-	SNIDomains   []string
-	Threads      int
-	UseGSO       bool
-	UseConntrack bool
-	SkipIpTables bool
+	// ConfigPath is the --config file the values were loaded from, if any.
+	ConfigPath string `json:"-"`
+	configYAML bool
 }
 
 var DefaultConfig = Config{
-	QueueStartNum:  537,
-	Mark:           1 << 15, // 32768
-	Threads:        4,
-	ConnBytesLimit: 19,
-	UseConntrack:   false,
-	UseGSO:         false,
-	SkipIpTables:   false,
-	Interface:      "*",
+	QueueStartNum:     537,
+	Mark:              1 << 15, // 32768
+	Threads:           4,
+	ConnBytesLimit:    19,
+	UDPConnBytesLimit: 8,
+	TCPPorts:          ports.Set{{Lo: 443, Hi: 443}},
+	UDPPorts:          ports.Set{{Lo: 443, Hi: 443}},
+	UseConntrack:      false,
+	UseGSO:            false,
+	SkipIpTables:      false,
+	Firewall:          FirewallAuto,
+	WatchdogInterval:  10,
+	StateDir:          "/var/run/b4",
+	LearnTTL:          3600,
+	LearnMax:          65536,
+	Interface:         "*",
 	Logging: Logging{
 		Level:      int(log.LevelInfo),
 		Instaflush: true,
 		Syslog:     false,
 	},
+	Strategy: Strategy{
+		FragTCP:           true,
+		FragSNIReverse:    true,
+		FragMiddleSNI:     true,
+		FragSNIPos:        1,
+		FakeSeqOffset:     10000,
+		FakeSNISeqLen:     1,
+		FakeType:          FakeTypeDefault,
+		FakeSNI:           "www.google.com",
+		Seg2Delay:         0,
+		UDPMode:           UDPModeFake,
+		UDPFakeSeqLen:     6,
+		UDPFakeLen:        64,
+		UDPFakingChecksum: false,
+	},
 }
 
+// ParseArgs loads the --config file (if any) on top of cfg and then applies
+// the command line flags, so flags always override file values.
 func (cfg *Config) ParseArgs(args []string) (*Config, error) {
+	var fileProfiles []fileProfile
+	if path := findConfigArg(args); path != "" {
+		fp, err := cfg.loadFile(path)
+		if err != nil {
+			log.Errorf("config file %q: %v", path, err)
+			return nil, err
+		}
+		fileProfiles = fp
+	}
 
 	fs := flag.NewFlagSet("b4", flag.ContinueOnError)
 
+	fs.String("config", cfg.ConfigPath, "Load settings from a JSON or YAML file")
+
 	fs.BoolVar(&cfg.Logging.Instaflush, "instaflush", cfg.Logging.Instaflush, "Enable instant flushing")
 	fs.BoolVar(&cfg.Logging.Syslog, "syslog", cfg.Logging.Syslog, "Enable syslog")
 
 	fs.IntVar(&cfg.Threads, "threads", cfg.Threads, "Set number of threads")
+	fs.Var(&cfg.TCPPorts, "tcp-ports", "Comma-separated TCP destination ports and ranges to process")
+	fs.Var(&cfg.UDPPorts, "udp-ports", "Comma-separated UDP destination ports and ranges to process")
+	fs.IntVar(&cfg.ConnBytesLimit, "connbytes-limit", cfg.ConnBytesLimit, "Queue only the first N packets of each TCP connection")
+	fs.IntVar(&cfg.UDPConnBytesLimit, "udp-connbytes-limit", cfg.UDPConnBytesLimit, "Queue only the first N packets of each UDP flow")
 
 	var (
-		logLevel       = fs.String("log-level", "info", "Set log level")
+		logLevel       = fs.String("log-level", levelName(cfg.Logging.Level), "Set log level")
 		sniDomainsFile = fs.String("sni-domains-file", "", "Set SNI domains file")
 	)
 
 	fs.BoolVar(&cfg.UseConntrack, "conntrack", cfg.UseConntrack, "Enable conntrack")
 	fs.BoolVar(&cfg.UseGSO, "gso", cfg.UseGSO, "Enable GSO")
 	fs.BoolVar(&cfg.SkipIpTables, "skip-iptables", cfg.SkipIpTables, "Skip iptables")
+	fs.StringVar(&cfg.Firewall, "firewall", cfg.Firewall, "Firewall backend: nft, iptables or auto")
 
 	fs.StringVar(&cfg.Interface, "iface", cfg.Interface, "Set sniffer interface")
+	fs.Var(csvFlag{&cfg.LANIfaces}, "lan-iface", "Comma-separated LAN interfaces for forwarded traffic (default: detect)")
+	fs.Var(csvFlag{&cfg.WANIfaces}, "wan-iface", "Comma-separated WAN interfaces (default: default route)")
+	fs.BoolVar(&cfg.OutputOnly, "output-only", cfg.OutputOnly, "Only queue locally generated traffic (no forwarding rules)")
+	fs.IntVar(&cfg.WatchInterval, "watch-interval", cfg.WatchInterval, "Seconds between config and domain file change checks (0 disables)")
+	fs.StringVar(&cfg.StateDir, "state-dir", cfg.StateDir, "Directory for the journal of applied firewall and sysctl changes")
+	fs.IntVar(&cfg.WatchdogInterval, "watchdog-interval", cfg.WatchdogInterval, "Seconds between firewall rule checks; missing rules are re-applied (0 disables)")
+
+	bindStrategyFlags(fs, &cfg.Strategy)
+
+	fs.StringVar(&cfg.GeoSiteFile, "geosite-file", cfg.GeoSiteFile, "Set v2ray geosite.dat file")
+	fs.Var(csvFlag{&cfg.GeoSite}, "geosite", "Comma-separated geosite categories to target, e.g. youtube,discord")
+	fs.StringVar(&cfg.GeoIPFile, "geoip-file", cfg.GeoIPFile, "Set v2ray geoip.dat file")
+	fs.Var(csvFlag{&cfg.GeoIP}, "geoip", "Comma-separated geoip categories whose CIDRs are targeted like --target-ips")
+	fs.Var(prefixFlag{&cfg.TargetIPs}, "target-ips", "Comma-separated IPs or CIDRs to target regardless of SNI")
+	fs.BoolVar(&cfg.LearnIPs, "learn-ips", cfg.LearnIPs, "Queue only servers of detected target hosts and --target-ips")
+	fs.IntVar(&cfg.LearnTTL, "learn-ttl", cfg.LearnTTL, "Seconds a learned server address stays queued")
+	fs.IntVar(&cfg.LearnMax, "learn-max", cfg.LearnMax, "Maximum number of learned addresses per family")
+	targetIPsFile := fs.String("target-ips-file", "", "Set file of IPs or CIDRs to target, one per line")
+
+	var profileSpecs, profileDomains, profileGeoSite multiFlag
+	fs.Var(&profileSpecs, "profile", "Define a strategy profile as name:key=val,... (repeatable)")
+	fs.Var(&profileDomains, "profile-domains", "Bind a domains file to a profile as name:path (repeatable)")
+	fs.Var(&profileGeoSite, "profile-geosite", "Bind geosite categories to a profile as name:cat,cat (repeatable)")
 
 	if err := fs.Parse(args); err != nil {
 		return nil, err
 	}
 
-	switch *logLevel {
-	case "info":
-		cfg.Logging.Level = int(log.LevelInfo)
-	case "trace":
-		cfg.Logging.Level = int(log.LevelTrace)
-	case "debug":
-		cfg.Logging.Level = int(log.LevelDebug)
-	default:
+	if lvl, ok := parseLevel(*logLevel); ok {
+		cfg.Logging.Level = lvl
+	} else {
 		cfg.Logging.Level = int(log.LevelInfo)
 	}
 
 	log.Tracef("sni domains file: %q", *sniDomainsFile)
-	if err := applyDomainFile(cfg, *sniDomainsFile); err != nil {
+	if *sniDomainsFile != "" {
+		cfg.SNIDomainsFiles = append(cfg.SNIDomainsFiles, *sniDomainsFile)
+	}
+	if err := applyDomainFiles(cfg); err != nil {
 		return nil, fmt.Errorf("domain file error: %w", err)
 	}
+	if *targetIPsFile != "" {
+		cfg.TargetIPsFiles = append(cfg.TargetIPsFiles, *targetIPsFile)
+	}
+	if err := applyIPFiles(cfg); err != nil {
+		return nil, fmt.Errorf("ip file error: %w", err)
+	}
+	if err := applyGeo(cfg); err != nil {
+		log.Errorf("geodat: %v", err)
+		return nil, err
+	}
+
+	if err := applyFileProfiles(cfg, fileProfiles); err != nil {
+		log.Errorf("profile error: %v", err)
+		return nil, err
+	}
+	if err := applyProfiles(cfg, profileSpecs, profileDomains, profileGeoSite); err != nil {
+		log.Errorf("profile error: %v", err)
+		return nil, err
+	}
+	if err := loadFakeHellos(cfg); err != nil {
+		log.Errorf("fake hello: %v", err)
+		return nil, err
+	}
+
+	if err := cfg.Validate(); err != nil {
+		log.Errorf("invalid config: %v", err)
+		return nil, err
+	}
 
 	return cfg, nil
 }
 
-func applyDomainFile(cfg *Config, includePath string) error {
-	if includePath != "" {
-		inc, err := readDomainFile(includePath)
+var levelNames = map[string]log.Level{
+	"error": log.LevelError,
+	"info":  log.LevelInfo,
+	"trace": log.LevelTrace,
+	"debug": log.LevelDebug,
+}
+
+func parseLevel(name string) (int, bool) {
+	l, ok := levelNames[strings.ToLower(strings.TrimSpace(name))]
+	return int(l), ok
+}
+
+func levelName(level int) string {
+	for n, l := range levelNames {
+		if int(l) == level {
+			return n
+		}
+	}
+	return "info"
+}
+
+func (cfg *Config) Validate() error {
+	if cfg.Threads < 1 {
+		return fmt.Errorf("threads must be at least 1, got %d", cfg.Threads)
+	}
+	if cfg.QueueStartNum < 0 || cfg.QueueStartNum+cfg.Threads-1 > 0xffff {
+		return fmt.Errorf("queue range %d..%d out of bounds", cfg.QueueStartNum, cfg.QueueStartNum+cfg.Threads-1)
+	}
+	if cfg.ConnBytesLimit < 1 || cfg.UDPConnBytesLimit < 1 {
+		return fmt.Errorf("connbytes limits must be at least 1, got %d/%d", cfg.ConnBytesLimit, cfg.UDPConnBytesLimit)
+	}
+	if len(cfg.TCPPorts) == 0 || len(cfg.UDPPorts) == 0 {
+		return fmt.Errorf("tcp-ports and udp-ports must not be empty")
+	}
+	if cfg.TCPPorts.Slots() > 15 || cfg.UDPPorts.Slots() > 15 {
+		return fmt.Errorf("port sets are limited to 15 ports (ranges count twice)")
+	}
+	switch cfg.Firewall {
+	case FirewallAuto, FirewallNFT, FirewallIPTables:
+	default:
+		return fmt.Errorf("firewall must be %q, %q or %q, got %q", FirewallAuto, FirewallNFT, FirewallIPTables, cfg.Firewall)
+	}
+	if cfg.WatchInterval < 0 {
+		return fmt.Errorf("watch-interval must not be negative, got %d", cfg.WatchInterval)
+	}
+	if cfg.StateDir == "" {
+		return fmt.Errorf("state-dir must not be empty")
+	}
+	if cfg.WatchdogInterval < 0 {
+		return fmt.Errorf("watchdog-interval must not be negative, got %d", cfg.WatchdogInterval)
+	}
+	if cfg.LearnTTL < 1 || cfg.LearnMax < 1 {
+		return fmt.Errorf("learn-ttl and learn-max must be at least 1, got %d/%d", cfg.LearnTTL, cfg.LearnMax)
+	}
+	if err := sni.NewMatcher().Add(cfg.AllSNIDomains(), 0); err != nil {
+		return err
+	}
+	if err := cfg.Strategy.Validate(); err != nil {
+		return err
+	}
+	return validateProfiles(cfg.Profiles)
+}
+
+// SplitsRecords reports whether st rewrites ClientHellos into several TLS
+// records.
+func (st *Strategy) SplitsRecords() bool {
+	return st.TLSRecSNI || st.TLSRecPos > 0
+}
+
+// SegmentOrder returns the order in which the n segments of a split
+// ClientHello are sent, as indexes into the segments. Segments a custom
+// FragOrder leaves out follow it in forward order.
+func (st *Strategy) SegmentOrder(n int) []int {
+	out := make([]int, 0, n)
+	switch st.FragOrder {
+	case "":
+		if !st.FragSNIReverse {
+			break
+		}
+		fallthrough
+	case FragOrderReverse:
+		for i := n - 1; i >= 0; i-- {
+			out = append(out, i)
+		}
+		return out
+	case FragOrderForward:
+	default:
+		perm, _ := parseFragOrder(st.FragOrder)
+		sent := make([]bool, n)
+		for _, k := range perm {
+			if k <= n && !sent[k-1] {
+				sent[k-1] = true
+				out = append(out, k-1)
+			}
+		}
+		for i := range n {
+			if !sent[i] {
+				out = append(out, i)
+			}
+		}
+		return out
+	}
+	for i := range n {
+		out = append(out, i)
+	}
+	return out
+}
+
+// parseFragOrder reads a permutation of 1-based segment numbers such as
+// "2,1,3".
+func parseFragOrder(s string) ([]int, error) {
+	var out []int
+	seen := make(map[int]bool)
+	for _, f := range strings.Split(s, ",") {
+		n, err := strconv.Atoi(strings.TrimSpace(f))
+		if err != nil || n < 1 || seen[n] {
+			return nil, fmt.Errorf("frag-order must be %q, %q or distinct segment numbers like 2,1,3, got %q",
+				FragOrderForward, FragOrderReverse, s)
+		}
+		seen[n] = true
+		out = append(out, n)
+	}
+	return out, nil
+}
+
+func (st *Strategy) Validate() error {
+	if st.FragSNIPos < 0 {
+		return fmt.Errorf("frag-sni-pos must not be negative, got %d", st.FragSNIPos)
+	}
+	switch st.FragOrder {
+	case "", FragOrderForward, FragOrderReverse:
+	default:
+		if _, err := parseFragOrder(st.FragOrder); err != nil {
+			return err
+		}
+	}
+	if st.FakeSeqOffset < 0 {
+		return fmt.Errorf("fake-seq-offset must not be negative, got %d", st.FakeSeqOffset)
+	}
+	if st.FakeSNISeqLen < 0 || st.FakeSNISeqLen > 64 {
+		return fmt.Errorf("fake-sni-seq-len must be in 0..64, got %d", st.FakeSNISeqLen)
+	}
+	if st.FakeTTL < 0 || st.FakeTTL > 255 || st.FakeAutoTTL < 0 || st.FakeAutoTTL > 255 {
+		return fmt.Errorf("fake-ttl and fake-auto-ttl must be in 0..255, got %d/%d", st.FakeTTL, st.FakeAutoTTL)
+	}
+	if st.FakeTSDecrease < 0 {
+		return fmt.Errorf("fake-ts-decrease must not be negative, got %d", st.FakeTSDecrease)
+	}
+	if st.TLSRecPos < 0 {
+		return fmt.Errorf("tlsrec-pos must not be negative, got %d", st.TLSRecPos)
+	}
+	if st.FakeSNI == "" || len(st.FakeSNI) > 253 || strings.ContainsAny(st.FakeSNI, " \t") {
+		return fmt.Errorf("fake-sni must be a host name, got %q", st.FakeSNI)
+	}
+	switch st.FakeType {
+	case FakeTypeDefault, FakeTypeRandom:
+	default:
+		return fmt.Errorf("fake-type must be %q or %q, got %q", FakeTypeDefault, FakeTypeRandom, st.FakeType)
+	}
+	if st.Seg2Delay < 0 || st.Seg2Delay > time.Second {
+		return fmt.Errorf("seg2delay must be in 0..1s, got %s", st.Seg2Delay)
+	}
+	switch st.UDPMode {
+	case UDPModeFake, UDPModeDrop, UDPModeNone:
+	default:
+		return fmt.Errorf("udp-mode must be %q, %q or %q, got %q", UDPModeFake, UDPModeDrop, UDPModeNone, st.UDPMode)
+	}
+	if st.UDPFakeSeqLen < 0 || st.UDPFakeSeqLen > 64 {
+		return fmt.Errorf("udp-fake-seq-len must be in 0..64, got %d", st.UDPFakeSeqLen)
+	}
+	if st.UDPFakeLen < 0 || st.UDPFakeLen > 1400 {
+		return fmt.Errorf("udp-fake-len must be in 0..1400, got %d", st.UDPFakeLen)
+	}
+	return nil
+}
+
+// loadFakeHellos reads the captured ClientHello of every strategy that names
+// one. Each must parse as a complete ClientHello in TLS records.
+func loadFakeHellos(cfg *Config) error {
+	strategies := []*Strategy{&cfg.Strategy}
+	for i := range cfg.Profiles {
+		strategies = append(strategies, &cfg.Profiles[i].Strategy)
+	}
+	for _, st := range strategies {
+		st.FakeHello = nil
+		if st.FakeHelloFile == "" {
+			continue
+		}
+		b, err := os.ReadFile(st.FakeHelloFile)
 		if err != nil {
-			log.Errorf("read %q: %w", includePath, err)
+			return err
+		}
+		if len(b) > 16*1024 {
+			return fmt.Errorf("%s: %d bytes, at most 16384 allowed", st.FakeHelloFile, len(b))
+		}
+		if h, err := tlshello.ParseRecords(b); err != nil || h.Truncated || h.Records[0].Off != 0 {
+			return fmt.Errorf("%s: not a complete TLS ClientHello record", st.FakeHelloFile)
+		}
+		st.FakeHello = b
+	}
+	return nil
+}
+
+func applyDomainFiles(cfg *Config) error {
+	for _, path := range cfg.SNIDomainsFiles {
+		inc, err := readDomainFile(path)
+		if err != nil {
+			log.Errorf("read %q: %v", path, err)
 			return err
 		}
 		cfg.SNIDomains = append(cfg.SNIDomains, inc...)
@@ -101,18 +475,29 @@ func applyDomainFile(cfg *Config, includePath string) error {
 
 	// Normalize + dedupe
 	cfg.SNIDomains = dedupeLower(cfg.SNIDomains)
-	log.Infof("Loaded SNI domains: %v", cfg.SNIDomains)
+	logRuleKinds("SNI domains", cfg.SNIDomains)
+	log.Tracef("Loaded SNI domains: %v", cfg.SNIDomains)
 	return nil
 }
 
+// dedupeLower normalizes rules in place. Regexp bodies keep their case since
+// it is significant in escapes like \D.
 func dedupeLower(in []string) []string {
 	seen := make(map[string]struct{}, len(in))
 	out := in[:0]
 	for _, s := range in {
-		s = strings.ToLower(strings.TrimSpace(s))
-		if s == "" {
+		kind, v := sni.SplitRule(s)
+		if v == "" {
 			continue
 		}
+		switch kind {
+		case sni.KindDomain:
+			s = strings.ToLower(v)
+		case sni.KindRegexp:
+			s = kind + ":" + v
+		default:
+			s = kind + ":" + strings.ToLower(v)
+		}
 		if _, ok := seen[s]; ok {
 			continue
 		}
@@ -122,6 +507,9 @@ func dedupeLower(in []string) []string {
 	return out
 }
 
+// readDomainFile reads a v2ray-style domain list. Entries keep their full:,
+// keyword: and regexp: prefixes for the matcher; domain: and bare entries are
+// suffix rules. Attributes (" @ads") and include: lines are ignored.
 func readDomainFile(path string) ([]string, error) {
 	f, err := os.Open(path)
 	if err != nil {
@@ -130,30 +518,47 @@ func readDomainFile(path string) ([]string, error) {
 	defer f.Close()
 	var out []string
 	sc := bufio.NewScanner(f)
+	sc.Buffer(make([]byte, 0, 64*1024), 1024*1024)
 	for sc.Scan() {
 		line := strings.TrimSpace(sc.Text())
-		if i := strings.IndexAny(line, "#;"); i >= 0 {
-			line = line[:i]
-		}
-		line = strings.TrimSpace(line)
-		if line == "" {
+		if line == "" || line[0] == '#' || line[0] == ';' {
 			continue
 		}
-		l := strings.ToLower(line)
-		if strings.HasPrefix(l, "full:") {
-			line = strings.TrimSpace(line[len("full:"):])
-		} else if strings.HasPrefix(l, "domain:") {
-			line = strings.TrimSpace(line[len("domain:"):])
-		} else if strings.HasPrefix(l, "regexp:") {
+		if strings.HasPrefix(strings.ToLower(line), "include:") {
+			log.Tracef("%s: skipping %q", path, line)
 			continue
 		}
-		if line == "" {
+		kind, v := sni.SplitRule(line)
+		if kind != sni.KindRegexp {
+			if i := strings.IndexAny(v, "#;"); i >= 0 {
+				v = v[:i]
+			}
+		}
+		if i := strings.IndexAny(v, " \t"); i >= 0 {
+			v = v[:i]
+		}
+		if v == "" {
 			continue
 		}
-		out = append(out, strings.ToLower(line))
+		if kind == sni.KindDomain {
+			out = append(out, strings.ToLower(v))
+		} else {
+			out = append(out, kind+":"+v)
+		}
 	}
 	if err := sc.Err(); err != nil {
 		return nil, err
 	}
+	logRuleKinds(path, out)
 	return out, nil
 }
+
+func logRuleKinds(source string, rules []string) {
+	var n = map[string]int{}
+	for _, r := range rules {
+		kind, _ := sni.SplitRule(r)
+		n[kind]++
+	}
+	log.Infof("%s: loaded %d domain, %d full, %d keyword, %d regexp rules",
+		source, n[sni.KindDomain], n[sni.KindFull], n[sni.KindKeyword], n[sni.KindRegexp])
+}
@@ -0,0 +1,130 @@
+package config
+
+import (
+	"slices"
+	"testing"
+
+	"github.com/daniellavrushin/b4/tlshello"
+)
+
+func TestParseFragOrder(t *testing.T) {
+	tests := []struct {
+		in   string
+		want []int
+		err  bool
+	}{
+		{in: "2,1,3", want: []int{2, 1, 3}},
+		{in: " 3 , 1 ", want: []int{3, 1}},
+		{in: "1", want: []int{1}},
+		{in: "10,2", want: []int{10, 2}},
+		{in: "", err: true},
+		{in: "2,,1", err: true},
+		{in: "0,1", err: true},
+		{in: "-1", err: true},
+		{in: "1,1", err: true},
+		{in: "2,x", err: true},
+		{in: "1.5", err: true},
+		{in: "reversed", err: true},
+	}
+	for _, tt := range tests {
+		got, err := parseFragOrder(tt.in)
+		if (err != nil) != tt.err || !slices.Equal(got, tt.want) {
+			t.Errorf("parseFragOrder(%q) = %v, %v, want %v, error %t", tt.in, got, err, tt.want, tt.err)
+		}
+	}
+}
+
+func TestSegmentOrder(t *testing.T) {
+	tests := []struct {
+		name    string
+		order   string
+		reverse bool
+		n       int
+		want    []int
+	}{
+		{name: "legacy forward", n: 3, want: []int{0, 1, 2}},
+		{name: "legacy reverse", reverse: true, n: 3, want: []int{2, 1, 0}},
+		{name: "forward overrides legacy reverse", order: FragOrderForward, reverse: true, n: 3, want: []int{0, 1, 2}},
+		{name: "reverse", order: FragOrderReverse, n: 4, want: []int{3, 2, 1, 0}},
+		{name: "permutation", order: "2,1,3", n: 3, want: []int{1, 0, 2}},
+		{name: "missing segments follow", order: "3", n: 4, want: []int{2, 0, 1, 3}},
+		{name: "numbers past n dropped", order: "5,2,1", n: 2, want: []int{1, 0}},
+		{name: "single segment", order: "2,1", n: 1, want: []int{0}},
+		{name: "no segments", order: FragOrderReverse, n: 0, want: []int{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			st := Strategy{FragOrder: tt.order, FragSNIReverse: tt.reverse}
+			if got := st.SegmentOrder(tt.n); !slices.Equal(got, tt.want) {
+				t.Errorf("SegmentOrder(%d) = %v, want %v", tt.n, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseArgsFragPositions(t *testing.T) {
+	tests := []struct {
+		name  string
+		args  []string
+		pos   tlshello.Positions
+		order string
+		err   bool
+	}{
+		{name: "defaults"},
+		{
+			name: "legacy default as positions",
+			args: []string{"--frag-pos", "1,136"},
+			pos:  tlshello.Positions{{Delta: 1}, {Delta: 136}},
+		},
+		{
+			name: "markers and offsets",
+			args: []string{"--frag-pos", "1, sni+1,midsni,sniext-2,host_end,-10"},
+			pos: tlshello.Positions{{Delta: 1}, {Marker: tlshello.MarkSNI, Delta: 1}, {Marker: tlshello.MarkMidSNI},
+				{Marker: tlshello.MarkSNIExt, Delta: -2}, {Marker: tlshello.MarkHostEnd}, {Delta: -10}},
+		},
+		{
+			name:  "order",
+			args:  []string{"--frag-pos", "sni,midsni", "--frag-order", "3,1"},
+			pos:   tlshello.Positions{{Marker: tlshello.MarkSNI}, {Marker: tlshello.MarkMidSNI}},
+			order: "3,1",
+		},
+		{name: "zero position", args: []string{"--frag-pos", "0"}, err: true},
+		{name: "unknown marker", args: []string{"--frag-pos", "1,tls+1"}, err: true},
+		{name: "bad offset", args: []string{"--frag-pos", "sni+x"}, err: true},
+		{name: "doubled sign", args: []string{"--frag-pos", "sni+-1"}, err: true},
+		{name: "bad order", args: []string{"--frag-order", "1,0"}, err: true},
+		{name: "repeated segment", args: []string{"--frag-order", "2,2"}, err: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			base := DefaultConfig
+			cfg, err := base.ParseArgs(tt.args)
+			if (err != nil) != tt.err {
+				t.Fatalf("err = %v, want error %t", err, tt.err)
+			}
+			if err != nil {
+				return
+			}
+			st := cfg.Strategy
+			if !slices.Equal(st.FragPos, tt.pos) || st.FragOrder != tt.order {
+				t.Errorf("positions %v order %q, want %v %q", st.FragPos, st.FragOrder, tt.pos, tt.order)
+			}
+			if st.FragSNIPos != 1 || !st.FragMiddleSNI || !st.FragSNIReverse {
+				t.Errorf("legacy knobs changed: %d %t %t", st.FragSNIPos, st.FragMiddleSNI, st.FragSNIReverse)
+			}
+		})
+	}
+}
+
+func TestProfileFragPositions(t *testing.T) {
+	st := DefaultConfig.Strategy
+	if err := parseStrategyOpts(&st, "p", "frag-pos=1,136,frag-order=reverse"); err != nil {
+		t.Fatal(err)
+	}
+	if want := (tlshello.Positions{{Delta: 1}, {Delta: 136}}); !slices.Equal(st.FragPos, want) || st.FragOrder != FragOrderReverse {
+		t.Errorf("positions %v order %q", st.FragPos, st.FragOrder)
+	}
+	if err := parseStrategyOpts(&st, "p", "frag-pos=1,midsni+x"); err == nil {
+		t.Errorf("invalid position accepted: %v", st.FragPos)
+	}
+}
@@ -0,0 +1,222 @@
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// fileProfile keeps the profile strategy undecoded until the global strategy
+// is final, so file profiles inherit CLI overrides like --profile does.
+type fileProfile struct {
+	Name            string          `json:"name"`
+	SNIDomains      []string        `json:"sni_domains"`
+	SNIDomainsFiles []string        `json:"sni_domains_files"`
+	GeoSite         []string        `json:"geosite"`
+	Strategy        json.RawMessage `json:"strategy"`
+}
+
+type configAlias Config
+
+type configFile struct {
+	*configAlias
+	Profiles []fileProfile `json:"profiles"`
+}
+
+// findConfigArg returns the value of --config without parsing the rest of
+// the flags, which need the file values as their defaults.
+func findConfigArg(args []string) string {
+	for i := 0; i < len(args); i++ {
+		a := args[i]
+		if a == "--" {
+			break
+		}
+		name := strings.TrimLeft(a, "-")
+		if name == a || len(a)-len(name) > 2 {
+			continue
+		}
+		if name == "config" && i+1 < len(args) {
+			return args[i+1]
+		}
+		if v, ok := strings.CutPrefix(name, "config="); ok {
+			return v
+		}
+	}
+	return ""
+}
+
+func (cfg *Config) loadFile(path string) ([]fileProfile, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	asYAML := isYAML(path, b)
+	if asYAML {
+		if b, err = yamlToJSON(b); err != nil {
+			return nil, err
+		}
+	}
+	f := configFile{configAlias: (*configAlias)(cfg)}
+	if err := decodeStrict(b, &f); err != nil {
+		return nil, err
+	}
+	cfg.ConfigPath = path
+	cfg.configYAML = asYAML
+	return f.Profiles, nil
+}
+
+func isYAML(path string, b []byte) bool {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		return true
+	case ".json":
+		return false
+	}
+	b = bytes.TrimSpace(b)
+	return len(b) == 0 || b[0] != '{'
+}
+
+func yamlToJSON(b []byte) ([]byte, error) {
+	var v any
+	if err := yaml.Unmarshal(b, &v); err != nil {
+		return nil, err
+	}
+	if v == nil {
+		v = map[string]any{}
+	}
+	return json.Marshal(v)
+}
+
+func decodeStrict(b []byte, v any) error {
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(v); err != nil {
+		return err
+	}
+	if dec.More() {
+		return fmt.Errorf("unexpected data after top-level value")
+	}
+	return nil
+}
+
+func applyFileProfiles(cfg *Config, fps []fileProfile) error {
+	for _, fp := range fps {
+		p := Profile{
+			Name:            strings.TrimSpace(fp.Name),
+			SNIDomains:      fp.SNIDomains,
+			SNIDomainsFiles: fp.SNIDomainsFiles,
+			GeoSite:         fp.GeoSite,
+			Strategy:        cfg.Strategy,
+		}
+		if len(fp.Strategy) > 0 {
+			if err := decodeStrict(fp.Strategy, &p.Strategy); err != nil {
+				return fmt.Errorf("profile %q: strategy: %w", p.Name, err)
+			}
+		}
+		for _, path := range p.SNIDomainsFiles {
+			list, err := readDomainFile(path)
+			if err != nil {
+				return fmt.Errorf("profile %q: read %q: %w", p.Name, path, err)
+			}
+			p.SNIDomains = append(p.SNIDomains, list...)
+		}
+		rules, err := loadGeoSite(cfg, p.GeoSite)
+		if err != nil {
+			return fmt.Errorf("profile %q: %w", p.Name, err)
+		}
+		p.SNIDomains = dedupeLower(append(p.SNIDomains, rules...))
+		cfg.Profiles = append(cfg.Profiles, p)
+	}
+	return nil
+}
+
+// Dump writes the effective configuration. YAML is used when the config was
+// loaded from a YAML file, JSON otherwise.
+func (cfg *Config) Dump(w io.Writer) error {
+	b, err := json.MarshalIndent(cfg, "", "  ")
+	if err != nil {
+		return err
+	}
+	if !cfg.configYAML {
+		_, err = fmt.Fprintf(w, "%s\n", b)
+		return err
+	}
+	var node yaml.Node
+	if err := yaml.Unmarshal(b, &node); err != nil {
+		return err
+	}
+	blockStyle(&node)
+	enc := yaml.NewEncoder(w)
+	enc.SetIndent(2)
+	if err := enc.Encode(&node); err != nil {
+		return err
+	}
+	return enc.Close()
+}
+
+func blockStyle(n *yaml.Node) {
+	n.Style &^= yaml.FlowStyle
+	if n.Kind == yaml.ScalarNode && n.Tag == "!!str" {
+		n.Style &^= yaml.DoubleQuotedStyle
+	}
+	for _, c := range n.Content {
+		blockStyle(c)
+	}
+}
+
+func (l Logging) MarshalJSON() ([]byte, error) {
+	type plain Logging
+	return json.Marshal(struct {
+		plain
+		Level string `json:"level"`
+	}{plain(l), levelName(l.Level)})
+}
+
+func (l *Logging) UnmarshalJSON(b []byte) error {
+	type plain Logging
+	aux := struct {
+		*plain
+		Level string `json:"level"`
+	}{plain: (*plain)(l), Level: levelName(l.Level)}
+	if err := decodeStrict(b, &aux); err != nil {
+		return err
+	}
+	lvl, ok := parseLevel(aux.Level)
+	if !ok {
+		return fmt.Errorf("unknown log level %q", aux.Level)
+	}
+	l.Level = lvl
+	return nil
+}
+
+func (st Strategy) MarshalJSON() ([]byte, error) {
+	type plain Strategy
+	return json.Marshal(struct {
+		plain
+		Seg2Delay string `json:"seg2delay"`
+	}{plain(st), st.Seg2Delay.String()})
+}
+
+func (st *Strategy) UnmarshalJSON(b []byte) error {
+	type plain Strategy
+	aux := struct {
+		*plain
+		Seg2Delay string `json:"seg2delay"`
+	}{plain: (*plain)(st), Seg2Delay: st.Seg2Delay.String()}
+	if err := decodeStrict(b, &aux); err != nil {
+		return err
+	}
+	d, err := time.ParseDuration(aux.Seg2Delay)
+	if err != nil {
+		return fmt.Errorf("seg2delay: %w", err)
+	}
+	st.Seg2Delay = d
+	return nil
+}
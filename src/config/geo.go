@@ -0,0 +1,181 @@
+package config
+
+import (
+	"bufio"
+	"fmt"
+	"net/netip"
+	"os"
+	"strings"
+
+	"github.com/daniellavrushin/b4/geodat"
+	"github.com/daniellavrushin/b4/log"
+)
+
+type csvFlag struct{ p *[]string }
+
+func (c csvFlag) String() string {
+	if c.p == nil {
+		return ""
+	}
+	return strings.Join(*c.p, ",")
+}
+
+func (c csvFlag) Set(v string) error {
+	*c.p = splitCSV(v)
+	return nil
+}
+
+func splitCSV(v string) []string {
+	var out []string
+	for _, s := range strings.Split(v, ",") {
+		if s = strings.TrimSpace(s); s != "" {
+			out = append(out, s)
+		}
+	}
+	return out
+}
+
+// prefixFlag parses comma-separated addresses and prefixes; a bare address
+// is a single-host prefix.
+type prefixFlag struct{ p *[]netip.Prefix }
+
+func (f prefixFlag) String() string {
+	if f.p == nil {
+		return ""
+	}
+	out := make([]string, len(*f.p))
+	for i, p := range *f.p {
+		out[i] = p.String()
+	}
+	return strings.Join(out, ",")
+}
+
+func (f prefixFlag) Set(v string) error {
+	var out []netip.Prefix
+	for _, s := range splitCSV(v) {
+		p, err := parsePrefix(s)
+		if err != nil {
+			return err
+		}
+		out = append(out, p)
+	}
+	*f.p = dedupePrefixes(out)
+	return nil
+}
+
+func parsePrefix(s string) (netip.Prefix, error) {
+	if strings.Contains(s, "/") {
+		p, err := netip.ParsePrefix(s)
+		if err != nil {
+			return netip.Prefix{}, err
+		}
+		return p.Masked(), nil
+	}
+	a, err := netip.ParseAddr(s)
+	if err != nil {
+		return netip.Prefix{}, err
+	}
+	a = a.Unmap()
+	return netip.PrefixFrom(a, a.BitLen()), nil
+}
+
+// readIPFile reads one address or prefix per line; # and ; start comments.
+func readIPFile(path string) ([]netip.Prefix, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var out []netip.Prefix
+	sc := bufio.NewScanner(f)
+	for n := 1; sc.Scan(); n++ {
+		line := sc.Text()
+		if i := strings.IndexAny(line, "#;"); i >= 0 {
+			line = line[:i]
+		}
+		if line = strings.TrimSpace(line); line == "" {
+			continue
+		}
+		p, err := parsePrefix(line)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", n, err)
+		}
+		out = append(out, p)
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// applyIPFiles adds the target IP files to TargetIPs. Once TargetIPs is set
+// the firewall queues only its destinations, with a set per family even when
+// one is empty, so that family queues nothing rather than everything.
+func applyIPFiles(cfg *Config) error {
+	for _, path := range cfg.TargetIPsFiles {
+		prefixes, err := readIPFile(path)
+		if err != nil {
+			log.Errorf("read %q: %v", path, err)
+			return err
+		}
+		log.Infof("%s: loaded %d CIDRs", path, len(prefixes))
+		cfg.TargetIPs = append(cfg.TargetIPs, prefixes...)
+	}
+	cfg.TargetIPs = dedupePrefixes(cfg.TargetIPs)
+	return nil
+}
+
+func loadGeoSite(cfg *Config, categories []string) ([]string, error) {
+	if len(categories) == 0 {
+		return nil, nil
+	}
+	if cfg.GeoSiteFile == "" {
+		return nil, fmt.Errorf("geosite categories %v need --geosite-file", categories)
+	}
+	rules, err := geodat.LoadSites(cfg.GeoSiteFile, categories)
+	if err != nil {
+		return nil, err
+	}
+	logRuleKinds(fmt.Sprintf("%s [%s]", cfg.GeoSiteFile, strings.Join(categories, ",")), rules)
+	return rules, nil
+}
+
+// applyGeo adds the selected geosite categories to the global domain rules
+// and the geoip categories to TargetIPs, where they restrict the queue rules
+// and match in mangle like --target-ips.
+func applyGeo(cfg *Config) error {
+	rules, err := loadGeoSite(cfg, cfg.GeoSite)
+	if err != nil {
+		return err
+	}
+	if len(rules) > 0 {
+		cfg.SNIDomains = dedupeLower(append(cfg.SNIDomains, rules...))
+	}
+	if len(cfg.GeoIP) == 0 {
+		return nil
+	}
+	if cfg.GeoIPFile == "" {
+		return fmt.Errorf("geoip categories %v need --geoip-file", cfg.GeoIP)
+	}
+	prefixes, err := geodat.LoadIPs(cfg.GeoIPFile, cfg.GeoIP)
+	if err != nil {
+		return err
+	}
+	log.Infof("%s [%s]: loaded %d CIDRs", cfg.GeoIPFile, strings.Join(cfg.GeoIP, ","), len(prefixes))
+	cfg.TargetIPs = dedupePrefixes(append(cfg.TargetIPs, prefixes...))
+	return nil
+}
+
+func dedupePrefixes(in []netip.Prefix) []netip.Prefix {
+	seen := make(map[netip.Prefix]struct{}, len(in))
+	out := in[:0]
+	for _, p := range in {
+		p = p.Masked()
+		if _, ok := seen[p]; ok {
+			continue
+		}
+		seen[p] = struct{}{}
+		out = append(out, p)
+	}
+	return out
+}
@@ -0,0 +1,247 @@
+package config
+
+import (
+	"flag"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Profile binds a set of domains to its own Strategy. Profiles start as a
+// copy of the global Strategy and override individual knobs.
+type Profile struct {
+	Name            string   `json:"name"`
+	SNIDomains      []string `json:"sni_domains"`
+	SNIDomainsFiles []string `json:"sni_domains_files,omitempty"`
+	GeoSite         []string `json:"geosite,omitempty"`
+	Strategy        Strategy `json:"strategy"`
+}
+
+type multiFlag []string
+
+func (m *multiFlag) String() string { return strings.Join(*m, " ") }
+
+func (m *multiFlag) Set(v string) error {
+	*m = append(*m, v)
+	return nil
+}
+
+// udpFakeFlag keeps the boolean --udp-fake of earlier versions working as
+// an alias of --udp-mode.
+type udpFakeFlag struct{ mode *string }
+
+func (f udpFakeFlag) IsBoolFlag() bool { return true }
+
+func (f udpFakeFlag) String() string {
+	if f.mode == nil {
+		return "false"
+	}
+	return strconv.FormatBool(*f.mode == UDPModeFake)
+}
+
+func (f udpFakeFlag) Set(v string) error {
+	on, err := strconv.ParseBool(v)
+	if err != nil {
+		return err
+	}
+	*f.mode = UDPModeNone
+	if on {
+		*f.mode = UDPModeFake
+	}
+	return nil
+}
+
+func bindStrategyFlags(fs *flag.FlagSet, st *Strategy) {
+	fs.BoolVar(&st.FragTCP, "frag-tcp", st.FragTCP, "Split matched ClientHello into TCP segments")
+	fs.BoolVar(&st.FragSNIReverse, "frag-sni-reverse", st.FragSNIReverse, "Send TCP segments in reverse order")
+	fs.BoolVar(&st.FragMiddleSNI, "frag-middle-sni", st.FragMiddleSNI, "Add a split point in the middle of the SNI")
+	fs.IntVar(&st.FragSNIPos, "frag-sni-pos", st.FragSNIPos, "Split position from the start of the TCP payload (0 disables)")
+	fs.Var(&st.FragPos, "frag-pos", "Comma-separated split positions: N, -N from the end, or sni, midsni, host_end, sniext with an optional +N/-N (replaces --frag-sni-pos and --frag-middle-sni)")
+	fs.StringVar(&st.FragOrder, "frag-order", st.FragOrder, "Order of the TCP segments: forward, reverse or segment numbers like 2,1,3 (replaces --frag-sni-reverse)")
+	fs.IntVar(&st.FakeSeqOffset, "fake-seq-offset", st.FakeSeqOffset, "Sequence offset subtracted from fake ClientHello packets")
+	fs.IntVar(&st.FakeSNISeqLen, "fake-sni-seq-len", st.FakeSNISeqLen, "Number of fake ClientHello packets to send")
+	fs.StringVar(&st.FakeType, "fake-type", st.FakeType, "Fake ClientHello payload: default (ClientHello for --fake-sni) or random")
+	fs.StringVar(&st.FakeSNI, "fake-sni", st.FakeSNI, "Decoy SNI of fake ClientHello packets")
+	fs.BoolVar(&st.FakePad, "fake-pad", st.FakePad, "Pad fake ClientHello packets to the length of the real one")
+	fs.StringVar(&st.FakeHelloFile, "fake-hello-file", st.FakeHelloFile, "Send this captured ClientHello (raw TLS records) as the fake")
+	fs.IntVar(&st.FakeTTL, "fake-ttl", st.FakeTTL, "TTL/hop limit of fake packets, so they expire before the server (0 keeps the original)")
+	fs.IntVar(&st.FakeAutoTTL, "fake-auto-ttl", st.FakeAutoTTL, "Set fake TTL to the server's hop distance from its SYN-ACK minus N (0 disables)")
+	fs.BoolVar(&st.FakeBadSum, "fake-badsum", st.FakeBadSum, "Break the TCP checksum of fake ClientHello packets")
+	fs.BoolVar(&st.FakeMD5Sig, "fake-md5sig", st.FakeMD5Sig, "Add a TCP MD5 signature option to fake ClientHello packets")
+	fs.BoolVar(&st.FakeBadAck, "fake-badack", st.FakeBadAck, "Send fake ClientHello packets with an acknowledgment number the server never sent")
+	fs.IntVar(&st.FakeTSDecrease, "fake-ts-decrease", st.FakeTSDecrease, "Decrease the TCP timestamp of fake ClientHello packets by N so PAWS drops them (0 disables)")
+	fs.BoolVar(&st.TLSRecSNI, "tlsrec-sni", st.TLSRecSNI, "Split the ClientHello into two TLS records in the middle of the SNI")
+	fs.IntVar(&st.TLSRecPos, "tlsrec-pos", st.TLSRecPos, "Split the ClientHello into TLS records N bytes into the handshake message (0 disables)")
+	fs.DurationVar(&st.Seg2Delay, "seg2delay", st.Seg2Delay, "Delay between the first and second TCP segment")
+	fs.StringVar(&st.UDPMode, "udp-mode", st.UDPMode, "Matched QUIC handling: fake, drop or none")
+	fs.Var(udpFakeFlag{&st.UDPMode}, "udp-fake", "Deprecated: use --udp-mode=fake or --udp-mode=none")
+	fs.IntVar(&st.UDPFakeSeqLen, "udp-fake-seq-len", st.UDPFakeSeqLen, "Number of fake UDP packets to send")
+	fs.IntVar(&st.UDPFakeLen, "udp-fake-len", st.UDPFakeLen, "Payload length of fake UDP packets")
+	fs.BoolVar(&st.UDPFakingChecksum, "udp-faking-checksum", st.UDPFakingChecksum, "Break the checksum of fake UDP packets")
+}
+
+// applyProfiles applies --profile name:key=val,..., --profile-domains
+// name:path and --profile-geosite name:cat,cat flags. A --profile naming a profile from the config file
+// overrides its knobs; new profiles are appended in declaration order.
+func applyProfiles(cfg *Config, specs, domains, geosite []string) error {
+	byName := make(map[string]int, len(cfg.Profiles)+len(specs))
+	for i, p := range cfg.Profiles {
+		byName[p.Name] = i
+	}
+	declared := make(map[string]struct{}, len(specs))
+	for _, spec := range specs {
+		name, opts, _ := strings.Cut(spec, ":")
+		name = strings.TrimSpace(name)
+		if name == "" {
+			return fmt.Errorf("profile %q: missing name", spec)
+		}
+		if _, ok := declared[name]; ok {
+			return fmt.Errorf("profile %q defined twice", name)
+		}
+		declared[name] = struct{}{}
+		i, ok := byName[name]
+		if !ok {
+			cfg.Profiles = append(cfg.Profiles, Profile{Name: name, Strategy: cfg.Strategy})
+			i = len(cfg.Profiles) - 1
+			byName[name] = i
+		}
+		if err := parseStrategyOpts(&cfg.Profiles[i].Strategy, name, opts); err != nil {
+			return err
+		}
+	}
+	for _, d := range domains {
+		name, path, ok := strings.Cut(d, ":")
+		path = strings.TrimSpace(path)
+		if !ok || path == "" {
+			return fmt.Errorf("profile-domains %q: expected name:path", d)
+		}
+		i, ok := byName[strings.TrimSpace(name)]
+		if !ok {
+			return fmt.Errorf("profile-domains %q: unknown profile %q", d, name)
+		}
+		p := &cfg.Profiles[i]
+		list, err := readDomainFile(path)
+		if err != nil {
+			return fmt.Errorf("profile %q: read %q: %w", p.Name, path, err)
+		}
+		p.SNIDomainsFiles = append(p.SNIDomainsFiles, path)
+		p.SNIDomains = dedupeLower(append(p.SNIDomains, list...))
+	}
+	for _, g := range geosite {
+		name, cats, ok := strings.Cut(g, ":")
+		i, known := byName[strings.TrimSpace(name)]
+		if !ok || !known {
+			return fmt.Errorf("profile-geosite %q: expected name:cat,cat for a defined profile", g)
+		}
+		p := &cfg.Profiles[i]
+		list := splitCSV(cats)
+		rules, err := loadGeoSite(cfg, list)
+		if err != nil {
+			return fmt.Errorf("profile %q: %w", p.Name, err)
+		}
+		p.GeoSite = append(p.GeoSite, list...)
+		p.SNIDomains = dedupeLower(append(p.SNIDomains, rules...))
+	}
+	return nil
+}
+
+func parseStrategyOpts(st *Strategy, name, opts string) error {
+	fs := flag.NewFlagSet("profile "+name, flag.ContinueOnError)
+	fs.SetOutput(new(strings.Builder))
+	bindStrategyFlags(fs, st)
+	var args []string
+	for _, kv := range strings.Split(opts, ",") {
+		kv = strings.TrimSpace(kv)
+		if kv == "" {
+			continue
+		}
+		// A piece naming no flag continues the list value before it, as
+		// in frag-pos=1,midsni.
+		name, _, _ := strings.Cut(kv, "=")
+		if n := len(args); n > 0 && fs.Lookup(name) == nil && strings.Contains(args[n-1], "=") {
+			args[n-1] += "," + kv
+			continue
+		}
+		args = append(args, "-"+kv)
+	}
+	if err := fs.Parse(args); err != nil {
+		return fmt.Errorf("profile %q: %w", name, err)
+	}
+	if fs.NArg() > 0 {
+		return fmt.Errorf("profile %q: unexpected %q", name, fs.Args())
+	}
+	return nil
+}
+
+func validateProfiles(profiles []Profile) error {
+	seen := make(map[string]struct{}, len(profiles))
+	for i := range profiles {
+		p := &profiles[i]
+		if p.Name == "" {
+			return fmt.Errorf("profile #%d has no name", i)
+		}
+		if _, ok := seen[p.Name]; ok {
+			return fmt.Errorf("profile %q defined twice", p.Name)
+		}
+		seen[p.Name] = struct{}{}
+		if len(p.SNIDomains) == 0 {
+			return fmt.Errorf("profile %q has no domains", p.Name)
+		}
+		if err := p.Strategy.Validate(); err != nil {
+			return fmt.Errorf("profile %q: %w", p.Name, err)
+		}
+	}
+	return nil
+}
+
+// AllSNIDomains returns the global domain list together with every profile's
+// domains, for consumers that only need to know whether a host is targeted.
+func (cfg *Config) AllSNIDomains() []string {
+	out := append([]string(nil), cfg.SNIDomains...)
+	for _, p := range cfg.Profiles {
+		out = append(out, p.SNIDomains...)
+	}
+	return dedupeLower(out)
+}
+
+// SplitsRecords reports whether the global strategy or any profile splits
+// ClientHellos into TLS records. The added record headers grow the stream,
+// so the firewall queues every segment of such a connection, both ways, by
+// its conntrack mark, and mangle shifts the sequence numbers to match.
+func (cfg *Config) SplitsRecords() bool {
+	if cfg.Strategy.SplitsRecords() {
+		return true
+	}
+	for i := range cfg.Profiles {
+		if cfg.Profiles[i].Strategy.SplitsRecords() {
+			return true
+		}
+	}
+	return false
+}
+
+// WatchedFiles lists every file the effective config was built from.
+func (cfg *Config) WatchedFiles() []string {
+	var out []string
+	if cfg.ConfigPath != "" {
+		out = append(out, cfg.ConfigPath)
+	}
+	out = append(out, cfg.SNIDomainsFiles...)
+	if cfg.GeoSiteFile != "" {
+		out = append(out, cfg.GeoSiteFile)
+	}
+	if cfg.GeoIPFile != "" {
+		out = append(out, cfg.GeoIPFile)
+	}
+	out = append(out, cfg.TargetIPsFiles...)
+	if cfg.Strategy.FakeHelloFile != "" {
+		out = append(out, cfg.Strategy.FakeHelloFile)
+	}
+	for _, p := range cfg.Profiles {
+		out = append(out, p.SNIDomainsFiles...)
+		if p.Strategy.FakeHelloFile != "" && p.Strategy.FakeHelloFile != cfg.Strategy.FakeHelloFile {
+			out = append(out, p.Strategy.FakeHelloFile)
+		}
+	}
+	return out
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"net/netip"
+	"os/exec"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/daniellavrushin/b4/config"
+	"github.com/daniellavrushin/b4/iptables"
+	"github.com/daniellavrushin/b4/log"
+	"github.com/daniellavrushin/b4/netif"
+	"github.com/daniellavrushin/b4/nftables"
+)
+
+// firewallBackend resolves --firewall=auto: nft is used when the kernel
+// supports nf_tables and iptables is either missing or itself the nf_tables
+// variant, so a legacy xtables setup keeps getting legacy rules.
+func firewallBackend(cfg *config.Config) string {
+	if cfg.Firewall != config.FirewallAuto {
+		return cfg.Firewall
+	}
+	if !nftables.Available() {
+		return config.FirewallIPTables
+	}
+	if _, err := exec.LookPath("iptables"); err != nil {
+		return config.FirewallNFT
+	}
+	out, _ := exec.Command("iptables", "-V").CombinedOutput()
+	if strings.Contains(string(out), "nf_tables") {
+		return config.FirewallNFT
+	}
+	return config.FirewallIPTables
+}
+
+func addRules(cfg *config.Config) error {
+	backend := firewallBackend(cfg)
+	log.Tracef("firewall backend: %s", backend)
+	if backend == config.FirewallNFT {
+		return nftables.AddRules(cfg)
+	}
+	return iptables.AddRules(cfg)
+}
+
+func clearRules(cfg *config.Config) error {
+	if firewallBackend(cfg) == config.FirewallNFT {
+		return nftables.ClearRules(cfg)
+	}
+	return iptables.ClearRules(cfg)
+}
+
+func verifyRules(cfg *config.Config) error {
+	if firewallBackend(cfg) == config.FirewallNFT {
+		return nftables.Verify(cfg)
+	}
+	return iptables.Verify(cfg)
+}
+
+func loadTargets(cfg *config.Config) error {
+	if firewallBackend(cfg) == config.FirewallNFT {
+		return nftables.LoadTargets(cfg)
+	}
+	return iptables.LoadTargets(cfg)
+}
+
+func learnAddr(cfg *config.Config, addr netip.Addr) error {
+	if firewallBackend(cfg) == config.FirewallNFT {
+		return nftables.Learn(addr, time.Duration(cfg.LearnTTL)*time.Second)
+	}
+	return iptables.Learn(addr)
+}
+
+// ruleWatchdog re-applies the firewall rules when something else removed
+// them, as OpenWrt does on every fw3 reload or fw4 restart.
+type ruleWatchdog struct {
+	cfg  atomic.Pointer[config.Config]
+	stop chan struct{}
+	done chan struct{}
+}
+
+func newRuleWatchdog() *ruleWatchdog {
+	return &ruleWatchdog{stop: make(chan struct{}), done: make(chan struct{})}
+}
+
+// SetConfig makes repairs use the config of the latest reload, so they
+// restore its target sets rather than the startup ones.
+func (w *ruleWatchdog) SetConfig(cfg *config.Config) {
+	w.cfg.Store(cfg)
+}
+
+func (w *ruleWatchdog) Run(cfg *config.Config, every time.Duration) {
+	w.SetConfig(cfg)
+	t := time.NewTicker(every)
+	go func() {
+		defer close(w.done)
+		defer t.Stop()
+		for {
+			select {
+			case <-w.stop:
+				return
+			case <-t.C:
+			}
+			cfg := w.cfg.Load()
+			err := verifyRules(cfg)
+			if err == nil {
+				continue
+			}
+			log.Errorf("watchdog: firewall rules damaged (%v), re-applying", err)
+			if err := addRules(cfg); err != nil {
+				log.Errorf("watchdog: re-apply failed: %v", err)
+				continue
+			}
+			log.Infof("watchdog: firewall rules repaired")
+		}
+	}()
+}
+
+// Close stops the watchdog and waits for a repair in progress to finish, so
+// the rules are not re-added after shutdown cleared them.
+func (w *ruleWatchdog) Close() {
+	close(w.stop)
+	<-w.done
+}
+
+// resolveFirewall pins --firewall=auto to the detected backend and fills in
+// the WAN interfaces from the default route and the LAN interfaces from the
+// private addresses of the remaining ones, unless they were given explicitly
+// or only OUTPUT is hooked.
+func resolveFirewall(cfg *config.Config) {
+	cfg.Firewall = firewallBackend(cfg)
+	if cfg.OutputOnly {
+		return
+	}
+	if len(cfg.WANIfaces) == 0 {
+		wan, err := netif.DefaultRouteIfaces()
+		if err != nil {
+			log.Errorf("detect WAN interfaces: %v", err)
+		}
+		cfg.WANIfaces = wan
+	}
+	if len(cfg.LANIfaces) == 0 {
+		lan, err := netif.LANIfaces(cfg.WANIfaces)
+		if err != nil {
+			log.Errorf("detect LAN interfaces: %v", err)
+		}
+		cfg.LANIfaces = lan
+	}
+}
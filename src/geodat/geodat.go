@@ -0,0 +1,308 @@
+// Package geodat reads the v2ray geosite.dat and geoip.dat protobuf files.
+// Only the handful of fields b4 needs are decoded, so no protobuf runtime is
+// required.
+package geodat
+
+import (
+	"errors"
+	"fmt"
+	"net/netip"
+	"os"
+	"strings"
+)
+
+// Domain.Type values from v2ray's routercommon.proto.
+const (
+	typePlain  = 0
+	typeRegex  = 1
+	typeDomain = 2
+	typeFull   = 3
+)
+
+const (
+	wireVarint = 0
+	wireI64    = 1
+	wireBytes  = 2
+	wireI32    = 5
+)
+
+var errTruncated = errors.New("geodat: truncated message")
+
+// LoadSites returns the domain rules of the selected geosite categories in
+// the text list syntax understood by sni.Matcher (full:, keyword:, regexp:
+// prefixes, bare entries are suffix rules). A category may carry an
+// attribute filter, e.g. "google@ads".
+func LoadSites(path string, categories []string) ([]string, error) {
+	want, err := selection(categories)
+	if err != nil {
+		return nil, err
+	}
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var out []string
+	found := make(map[string]bool, len(want))
+	err = eachEntry(b, func(code string, entry []byte) error {
+		attrs, ok := want[code]
+		if !ok {
+			return nil
+		}
+		found[code] = true
+		return eachField(entry, func(num int, v []byte) error {
+			if num != 2 {
+				return nil
+			}
+			rule, keep, err := parseDomain(v, attrs)
+			if err != nil {
+				return fmt.Errorf("%s: %w", code, err)
+			}
+			if keep {
+				out = append(out, rule)
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	if err := missing(path, want, found); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// LoadIPs returns the CIDRs of the selected geoip categories.
+func LoadIPs(path string, categories []string) ([]netip.Prefix, error) {
+	want, err := selection(categories)
+	if err != nil {
+		return nil, err
+	}
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var out []netip.Prefix
+	found := make(map[string]bool, len(want))
+	err = eachEntry(b, func(code string, entry []byte) error {
+		if _, ok := want[code]; !ok {
+			return nil
+		}
+		found[code] = true
+		return eachField(entry, func(num int, v []byte) error {
+			if num != 2 {
+				return nil
+			}
+			p, err := parseCIDR(v)
+			if err != nil {
+				return fmt.Errorf("%s: %w", code, err)
+			}
+			out = append(out, p)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	if err := missing(path, want, found); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// selection maps upper-cased category codes to their attribute filters.
+func selection(categories []string) (map[string][]string, error) {
+	want := make(map[string][]string, len(categories))
+	for _, c := range categories {
+		c = strings.TrimSpace(c)
+		if c == "" {
+			continue
+		}
+		parts := strings.Split(c, "@")
+		code := strings.ToUpper(parts[0])
+		if code == "" {
+			return nil, fmt.Errorf("geodat: empty category in %q", c)
+		}
+		want[code] = append(want[code], parts[1:]...)
+	}
+	if len(want) == 0 {
+		return nil, errors.New("geodat: no categories selected")
+	}
+	return want, nil
+}
+
+func missing(path string, want map[string][]string, found map[string]bool) error {
+	var miss []string
+	for code := range want {
+		if !found[code] {
+			miss = append(miss, strings.ToLower(code))
+		}
+	}
+	if len(miss) > 0 {
+		return fmt.Errorf("geodat: %s: categories not found: %s", path, strings.Join(miss, ","))
+	}
+	return nil
+}
+
+// eachEntry walks the repeated entry field of a GeoSiteList or GeoIPList and
+// hands every entry with its upper-cased country_code to fn.
+func eachEntry(b []byte, fn func(code string, entry []byte) error) error {
+	return eachField(b, func(num int, entry []byte) error {
+		if num != 1 {
+			return nil
+		}
+		var code string
+		err := eachField(entry, func(n int, v []byte) error {
+			if n == 1 {
+				code = strings.ToUpper(string(v))
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		return fn(code, entry)
+	})
+}
+
+func parseDomain(b []byte, attrs []string) (string, bool, error) {
+	var (
+		typ   uint64
+		value string
+		have  = map[string]bool{}
+	)
+	err := eachFieldVarint(b, func(num int, v []byte, n uint64) error {
+		switch num {
+		case 1:
+			typ = n
+		case 2:
+			value = string(v)
+		case 3:
+			return eachField(v, func(an int, av []byte) error {
+				if an == 1 {
+					have[strings.ToLower(string(av))] = true
+				}
+				return nil
+			})
+		}
+		return nil
+	})
+	if err != nil {
+		return "", false, err
+	}
+	for _, a := range attrs {
+		if !have[strings.ToLower(a)] {
+			return "", false, nil
+		}
+	}
+	if value == "" {
+		return "", false, nil
+	}
+	switch typ {
+	case typePlain:
+		return "keyword:" + value, true, nil
+	case typeRegex:
+		return "regexp:" + value, true, nil
+	case typeFull:
+		return "full:" + value, true, nil
+	case typeDomain:
+		return value, true, nil
+	default:
+		return "", false, fmt.Errorf("unknown domain type %d", typ)
+	}
+}
+
+func parseCIDR(b []byte) (netip.Prefix, error) {
+	var (
+		ip     []byte
+		prefix uint64
+	)
+	err := eachFieldVarint(b, func(num int, v []byte, n uint64) error {
+		switch num {
+		case 1:
+			ip = v
+		case 2:
+			prefix = n
+		}
+		return nil
+	})
+	if err != nil {
+		return netip.Prefix{}, err
+	}
+	addr, ok := netip.AddrFromSlice(ip)
+	if !ok {
+		return netip.Prefix{}, fmt.Errorf("bad ip length %d", len(ip))
+	}
+	if prefix > uint64(addr.BitLen()) {
+		return netip.Prefix{}, fmt.Errorf("bad prefix /%d for %s", prefix, addr)
+	}
+	return netip.PrefixFrom(addr, int(prefix)).Masked(), nil
+}
+
+// eachField calls fn for every length-delimited field of a message and skips
+// all other wire types.
+func eachField(b []byte, fn func(num int, v []byte) error) error {
+	return eachFieldVarint(b, func(num int, v []byte, _ uint64) error {
+		if v == nil {
+			return nil
+		}
+		return fn(num, v)
+	})
+}
+
+// eachFieldVarint is eachField that also reports varint fields, with v nil.
+func eachFieldVarint(b []byte, fn func(num int, v []byte, n uint64) error) error {
+	for len(b) > 0 {
+		key, k := uvarint(b)
+		if k == 0 {
+			return errTruncated
+		}
+		b = b[k:]
+		num, wt := int(key>>3), int(key&7)
+		switch wt {
+		case wireVarint:
+			n, k := uvarint(b)
+			if k == 0 {
+				return errTruncated
+			}
+			b = b[k:]
+			if err := fn(num, nil, n); err != nil {
+				return err
+			}
+		case wireBytes:
+			l, k := uvarint(b)
+			if k == 0 || uint64(len(b)-k) < l {
+				return errTruncated
+			}
+			v := b[k : k+int(l)]
+			b = b[k+int(l):]
+			if err := fn(num, v, 0); err != nil {
+				return err
+			}
+		case wireI64:
+			if len(b) < 8 {
+				return errTruncated
+			}
+			b = b[8:]
+		case wireI32:
+			if len(b) < 4 {
+				return errTruncated
+			}
+			b = b[4:]
+		default:
+			return fmt.Errorf("geodat: unsupported wire type %d", wt)
+		}
+	}
+	return nil
+}
+
+func uvarint(b []byte) (uint64, int) {
+	var v uint64
+	for i := 0; i < len(b) && i < 10; i++ {
+		v |= uint64(b[i]&0x7f) << (7 * i)
+		if b[i] < 0x80 {
+			return v, i + 1
+		}
+	}
+	return 0, 0
+}
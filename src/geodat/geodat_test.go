@@ -0,0 +1,199 @@
+package geodat
+
+import (
+	"encoding/binary"
+	"errors"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+func key(num, wt int) []byte { return binary.AppendUvarint(nil, uint64(num<<3|wt)) }
+
+func varintField(num int, n uint64) []byte {
+	return binary.AppendUvarint(key(num, wireVarint), n)
+}
+
+func bytesField(num int, v []byte) []byte {
+	b := binary.AppendUvarint(key(num, wireBytes), uint64(len(v)))
+	return append(b, v...)
+}
+
+func cat(parts ...[]byte) []byte { return slices.Concat(parts...) }
+
+func domain(typ uint64, value string, attrs ...string) []byte {
+	b := cat(varintField(1, typ), bytesField(2, []byte(value)))
+	for _, a := range attrs {
+		b = append(b, bytesField(3, bytesField(1, []byte(a)))...)
+	}
+	return b
+}
+
+func TestUvarint(t *testing.T) {
+	tests := []struct {
+		in   []byte
+		v    uint64
+		size int
+	}{
+		{[]byte{0}, 0, 1},
+		{[]byte{0x7f}, 127, 1},
+		{[]byte{0xac, 0x02}, 300, 2},
+		{[]byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x01}, 1<<64 - 1, 10},
+		{[]byte{0x80}, 0, 0},
+		{nil, 0, 0},
+		{[]byte{0x80, 0x80, 0x80, 0x80, 0x80, 0x80, 0x80, 0x80, 0x80, 0x80, 0x01}, 0, 0},
+	}
+	for _, tt := range tests {
+		v, n := uvarint(tt.in)
+		if v != tt.v || n != tt.size {
+			t.Errorf("uvarint(%x) = %d, %d, want %d, %d", tt.in, v, n, tt.v, tt.size)
+		}
+	}
+}
+
+func TestEachFieldVarint(t *testing.T) {
+	type field struct {
+		num int
+		v   string
+		n   uint64
+	}
+	tests := []struct {
+		name   string
+		in     []byte
+		fields []field
+		err    bool
+	}{
+		{"varint", varintField(1, 300), []field{{1, "", 300}}, false},
+		{"bytes", bytesField(2, []byte("abc")), []field{{2, "abc", 0}}, false},
+		{"empty bytes", bytesField(2, nil), []field{{2, "", 0}}, false},
+		{"nested", bytesField(1, bytesField(2, []byte("x"))), []field{{1, "\x12\x01x", 0}}, false},
+		{"fixed widths skipped", cat(key(3, wireI64), make([]byte, 8), key(4, wireI32), make([]byte, 4), varintField(5, 1)), []field{{5, "", 1}}, false},
+		{"empty message", nil, nil, false},
+		{"truncated key", []byte{0x80}, nil, true},
+		{"truncated varint", cat(key(1, wireVarint), []byte{0x80}), nil, true},
+		{"truncated bytes", bytesField(2, []byte("abc"))[:3], nil, true},
+		{"length past the end", cat(key(2, wireBytes), []byte{10}, []byte("abc")), nil, true},
+		{"oversized length", cat(key(2, wireBytes), binary.AppendUvarint(nil, 1<<63), []byte("abc")), nil, true},
+		{"maximal length", cat(key(2, wireBytes), binary.AppendUvarint(nil, 1<<64-1)), nil, true},
+		{"truncated i64", cat(key(3, wireI64), make([]byte, 7)), nil, true},
+		{"truncated i32", cat(key(3, wireI32), make([]byte, 3)), nil, true},
+		{"group wire type", key(1, 3), nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got []field
+			err := eachFieldVarint(tt.in, func(num int, v []byte, n uint64) error {
+				got = append(got, field{num, string(v), n})
+				return nil
+			})
+			if (err != nil) != tt.err {
+				t.Fatalf("err = %v, want error %t", err, tt.err)
+			}
+			if !tt.err && !slices.Equal(got, tt.fields) {
+				t.Errorf("fields %q, want %q", got, tt.fields)
+			}
+		})
+	}
+}
+
+func TestParseDomain(t *testing.T) {
+	tests := []struct {
+		name  string
+		in    []byte
+		attrs []string
+		rule  string
+		keep  bool
+		err   bool
+	}{
+		{"plain is a keyword", domain(typePlain, "tube"), nil, "keyword:tube", true, false},
+		{"regex", domain(typeRegex, `^yt\d+\.`), nil, `regexp:^yt\d+\.`, true, false},
+		{"domain is a suffix", domain(typeDomain, "youtube.com"), nil, "youtube.com", true, false},
+		{"full", domain(typeFull, "www.youtube.com"), nil, "full:www.youtube.com", true, false},
+		{"unknown type", domain(7, "x.com"), nil, "", false, true},
+		{"empty value", domain(typeDomain, ""), nil, "", false, false},
+		{"attribute present", domain(typeDomain, "ads.example", "ADS"), []string{"ads"}, "ads.example", true, false},
+		{"attribute missing", domain(typeDomain, "example.com"), []string{"ads"}, "", false, false},
+		{"truncated", domain(typeDomain, "example.com")[:5], nil, "", false, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rule, keep, err := parseDomain(tt.in, tt.attrs)
+			if (err != nil) != tt.err || rule != tt.rule || keep != tt.keep {
+				t.Errorf("parseDomain = %q, %t, %v, want %q, %t, error %t", rule, keep, err, tt.rule, tt.keep, tt.err)
+			}
+		})
+	}
+}
+
+func TestParseCIDR(t *testing.T) {
+	tests := []struct {
+		name string
+		in   []byte
+		want string
+	}{
+		{"v4", cat(bytesField(1, []byte{192, 0, 2, 9}), varintField(2, 24)), "192.0.2.0/24"},
+		{"v6", cat(bytesField(1, netip.MustParseAddr("2001:db8::1").AsSlice()), varintField(2, 32)), "2001:db8::/32"},
+		{"bad length", cat(bytesField(1, []byte{1, 2, 3}), varintField(2, 8)), ""},
+		{"prefix too long", cat(bytesField(1, []byte{192, 0, 2, 0}), varintField(2, 33)), ""},
+		{"huge prefix", cat(bytesField(1, []byte{192, 0, 2, 0}), varintField(2, 1<<63)), ""},
+		{"truncated", bytesField(1, []byte{192, 0, 2, 0})[:4], ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, err := parseCIDR(tt.in)
+			if tt.want == "" {
+				if err == nil {
+					t.Errorf("parsed %s, want an error", p)
+				}
+				return
+			}
+			if err != nil || p.String() != tt.want {
+				t.Errorf("parseCIDR = %s, %v, want %s", p, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestLoad(t *testing.T) {
+	dir := t.TempDir()
+	sites := filepath.Join(dir, "geosite.dat")
+	site := cat(
+		bytesField(1, cat(bytesField(1, []byte("youtube")),
+			bytesField(2, domain(typeDomain, "youtube.com")),
+			bytesField(2, domain(typeFull, "ads.youtube.com", "ads")))),
+		bytesField(1, cat(bytesField(1, []byte("other")), bytesField(2, domain(typeDomain, "other.com")))),
+	)
+	if err := os.WriteFile(sites, site, 0600); err != nil {
+		t.Fatal(err)
+	}
+	got, err := LoadSites(sites, []string{"YouTube"})
+	if want := []string{"youtube.com", "full:ads.youtube.com"}; err != nil || !slices.Equal(got, want) {
+		t.Errorf("LoadSites = %q, %v, want %q", got, err, want)
+	}
+	got, err = LoadSites(sites, []string{"youtube@ads"})
+	if want := []string{"full:ads.youtube.com"}; err != nil || !slices.Equal(got, want) {
+		t.Errorf("LoadSites with attribute = %q, %v, want %q", got, err, want)
+	}
+	if _, err := LoadSites(sites, []string{"missing"}); err == nil {
+		t.Error("LoadSites of a missing category succeeded")
+	}
+
+	ips := filepath.Join(dir, "geoip.dat")
+	ip := bytesField(1, cat(bytesField(1, []byte("XX")),
+		bytesField(2, cat(bytesField(1, []byte{198, 51, 100, 0}), varintField(2, 24)))))
+	if err := os.WriteFile(ips, ip, 0600); err != nil {
+		t.Fatal(err)
+	}
+	prefixes, err := LoadIPs(ips, []string{"xx"})
+	if err != nil || len(prefixes) != 1 || prefixes[0].String() != "198.51.100.0/24" {
+		t.Errorf("LoadIPs = %v, %v", prefixes, err)
+	}
+	if err := os.WriteFile(ips, ip[:len(ip)-3], 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadIPs(ips, []string{"xx"}); !errors.Is(err, errTruncated) {
+		t.Errorf("LoadIPs of a truncated file: %v", err)
+	}
+}
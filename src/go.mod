@@ -4,9 +4,7 @@ go 1.24.2
 
 require (
 	github.com/google/go-cmp v0.6.0 // indirect
-	github.com/josharian/native v1.0.0 // indirect
-	github.com/mdlayher/netlink v1.6.0 // indirect
-	github.com/mdlayher/socket v0.1.1 // indirect
+	github.com/mdlayher/socket v0.5.0 // indirect
 	golang.org/x/net v0.42.0 // indirect
 	golang.org/x/sync v0.8.0 // indirect
 )
@@ -14,6 +12,9 @@ require (
 require (
 	github.com/florianl/go-nfqueue v1.3.2
 	github.com/google/gopacket v1.1.20-0.20250319234736-b7d9dbd15ae4
+	github.com/google/nftables v0.3.0
+	github.com/mdlayher/netlink v1.7.3-0.20250113171957-fbb4dce95f42
 	golang.org/x/crypto v0.40.0
 	golang.org/x/sys v0.35.0
+	gopkg.in/yaml.v3 v3.0.1
 )
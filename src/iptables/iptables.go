@@ -2,16 +2,18 @@ package iptables
 
 import (
 	"bytes"
-	"encoding/json"
 	"fmt"
-	"os"
+	"net/netip"
 	"os/exec"
+	"slices"
 	"strconv"
 	"strings"
-	"time"
 
+	"github.com/daniellavrushin/b4/cidr"
 	"github.com/daniellavrushin/b4/config"
 	"github.com/daniellavrushin/b4/log"
+	"github.com/daniellavrushin/b4/ports"
+	"github.com/daniellavrushin/b4/sysctl"
 )
 
 func run(args ...string) (string, error) {
@@ -23,48 +25,67 @@ func run(args ...string) (string, error) {
 	return out.String(), err
 }
 
+func runInput(stdin string, args ...string) (string, error) {
+	var out bytes.Buffer
+	cmd := exec.Command(args[0], args[1:]...)
+	cmd.Stdin = strings.NewReader(stdin)
+	cmd.Stdout = &out
+	cmd.Stderr = &out
+	err := cmd.Run()
+	return out.String(), err
+}
+
 func existsChain(ipt, table, chain string) bool {
 	_, err := run(ipt, "-w", "-t", table, "-S", chain)
 	return err == nil
 }
 
-func ensureChain(ipt, table, chain string) {
-	if !existsChain(ipt, table, chain) {
-		_, _ = run(ipt, "-w", "-t", table, "-N", chain)
-	}
-}
-
 func existsRule(ipt, table, chain string, spec []string) bool {
 	_, err := run(append([]string{ipt, "-w", "-t", table, "-C", chain}, spec...)...)
 	return err == nil
 }
 
-func delAll(ipt, table, chain string, spec []string) {
-	for {
-		_, err := run(append([]string{ipt, "-w", "-t", table, "-D", chain}, spec...)...)
-		if err != nil {
-			break
-		}
+func qbSpec(start, end int) []string {
+	if end > start {
+		return []string{"-j", "NFQUEUE", "--queue-balance",
+			strconv.Itoa(start) + ":" + strconv.Itoa(end), "--queue-bypass"}
 	}
+	return []string{"-j", "NFQUEUE", "--queue-num", strconv.Itoa(start), "--queue-bypass"}
 }
 
-func setSysctlOrProc(name, val string) {
-	_, _ = run("sh", "-c", "sysctl -w "+name+"="+val+" || echo "+val+" > /proc/sys/"+strings.ReplaceAll(name, ".", "/"))
+// portSpec matches the destination ports, using multiport only when the set
+// is more than a single port.
+func portSpec(proto string, p ports.Set) []string {
+	if p.Single() {
+		return []string{"-p", proto, "--dport", p.Multiport()}
+	}
+	return []string{"-p", proto, "-m", "multiport", "--dports", p.Multiport()}
 }
 
-func getSysctlOrProc(name string) string {
-	out, _ := run("sh", "-c", "sysctl -n "+name+" 2>/dev/null || cat /proc/sys/"+strings.ReplaceAll(name, ".", "/"))
-	return strings.TrimSpace(out)
+// srcPortSpec is portSpec for the source ports.
+func srcPortSpec(proto string, p ports.Set) []string {
+	if p.Single() {
+		return []string{"-p", proto, "--sport", p.Multiport()}
+	}
+	return []string{"-p", proto, "-m", "multiport", "--sports", p.Multiport()}
 }
 
-func qbSpec(start, end int) []string {
-	if end > start {
-		return []string{"-j", "NFQUEUE", "--queue-balance",
-			strconv.Itoa(start) + ":" + strconv.Itoa(end), "--queue-bypass"}
+func connbytesSpec(limit int) []string {
+	return []string{"-m", "connbytes", "--connbytes-dir", "original", "--connbytes-mode", "packets", "--connbytes", "0:" + strconv.Itoa(limit)}
+}
+
+func concat(parts ...[]string) []string {
+	var out []string
+	for _, p := range parts {
+		out = append(out, p...)
 	}
-	return []string{"-j", "NFQUEUE", "--queue-num", strconv.Itoa(start), "--queue-bypass"}
+	return out
 }
 
+// commentTag marks the rules b4 adds to chains it does not own, so they can
+// be found again in iptables-save output.
+const commentTag = "b4"
+
 type Rule struct {
 	IPT    string
 	Table  string
@@ -73,20 +94,28 @@ type Rule struct {
 	Action string
 }
 
-func (r Rule) Apply() error {
-	if existsRule(r.IPT, r.Table, r.Chain, r.Spec) {
-		return nil
-	}
+// line renders the rule as an iptables-restore command.
+func (r Rule) line() string {
 	op := "-A"
 	if strings.ToUpper(r.Action) == "I" {
 		op = "-I"
 	}
-	_, err := run(append([]string{r.IPT, "-w", "-t", r.Table, op, r.Chain}, r.Spec...)...)
-	return err
+	return r.command(op)
 }
 
-func (r Rule) Remove() {
-	delAll(r.IPT, r.Table, r.Chain, r.Spec)
+func (r Rule) command(op string) string {
+	args := make([]string, len(r.Spec))
+	for i, a := range r.Spec {
+		args[i] = quoteArg(a)
+	}
+	return op + " " + r.Chain + " " + strings.Join(args, " ")
+}
+
+func quoteArg(a string) string {
+	if a != "" && !strings.ContainsAny(a, " \t\"'") {
+		return a
+	}
+	return strconv.Quote(a)
 }
 
 type Chain struct {
@@ -95,106 +124,300 @@ type Chain struct {
 	Name  string
 }
 
-func (c Chain) Ensure() {
-	ensureChain(c.IPT, c.Table, c.Name)
+// IPSet is an ipset the rules match destinations against. Only its name is
+// journaled; the entries come from the config whenever it is loaded. Sets
+// with a Timeout are filled at runtime by Learn instead.
+type IPSet struct {
+	Name    string
+	Family  string
+	Timeout int      `json:",omitempty"`
+	MaxElem int      `json:",omitempty"`
+	Entries []string `json:"-"`
+}
+
+type Manifest struct {
+	Chains  []Chain
+	Rules   []Rule
+	Sets    []IPSet
+	Sysctls []sysctl.Setting
 }
 
-func (c Chain) Remove() {
-	if existsChain(c.IPT, c.Table, c.Name) {
-		_, _ = run(c.IPT, "-w", "-t", c.Table, "-F", c.Name)
-		_, _ = run(c.IPT, "-w", "-t", c.Table, "-X", c.Name)
+// Apply installs the rules with one iptables-restore --noflush transaction
+// per family and checks every rule with -C afterwards. On any failure the
+// families already installed are rolled back, so nothing is left behind.
+func (m Manifest) Apply() error {
+	if err := loadSets(m.Sets); err != nil {
+		return err
 	}
+	var done []string
+	for _, ipt := range m.families() {
+		cur, err := saveMangle(ipt)
+		if err != nil {
+			m.rollback(done)
+			return err
+		}
+		if err := restore(ipt, restoreScript(ipt, m, cur)); err != nil {
+			m.rollback(done)
+			return err
+		}
+		done = append(done, ipt)
+	}
+	if err := m.verify(); err != nil {
+		m.rollback(done)
+		return err
+	}
+	for _, s := range m.Sysctls {
+		s.Apply()
+	}
+	return nil
 }
 
-type SysctlSetting struct {
-	Name    string
-	Desired string
-	Revert  string
+func (m Manifest) verify() error {
+	for _, r := range m.Rules {
+		if !existsRule(r.IPT, r.Table, r.Chain, r.Spec) {
+			return fmt.Errorf("%s: rule missing after install: %s", r.IPT, r.line())
+		}
+	}
+	return nil
+}
+
+func (m Manifest) rollback(ipts []string) {
+	for _, ipt := range ipts {
+		if err := removeFamily(ipt); err != nil {
+			log.Errorf("IPTABLES: rollback %s: %v", ipt, err)
+		}
+	}
+	if err := destroySets(m.Sets); err != nil {
+		log.Errorf("IPTABLES: rollback: %v", err)
+	}
+}
+
+func (m Manifest) families() []string {
+	var out []string
+	for _, c := range m.Chains {
+		if !slices.Contains(out, c.IPT) {
+			out = append(out, c.IPT)
+		}
+	}
+	return out
 }
 
-var sysctlSnapPath = "/tmp/b4_sysctl_snapshot.json"
+func (m Manifest) RevertSysctls() {
+	for _, s := range m.Sysctls {
+		s.RevertBack()
+	}
+}
+
+// setScript renders the ipset restore input that fills the sets. Each set
+// is built under a temporary name and swapped in, so rules matching it never
+// see it half loaded. Learned sets are only created, keeping their entries
+// when the rules are re-applied.
+func setScript(sets []IPSet) string {
+	var b strings.Builder
+	for _, st := range sets {
+		if st.Timeout > 0 {
+			fmt.Fprintf(&b, "create %s hash:ip family %s timeout %d maxelem %d\n", st.Name, st.Family, st.Timeout, st.MaxElem)
+			continue
+		}
+		tmp := st.Name + "_new"
+		maxelem := max(65536, len(st.Entries))
+		fmt.Fprintf(&b, "create %s hash:net family %s maxelem %d\n", st.Name, st.Family, maxelem)
+		fmt.Fprintf(&b, "create %s hash:net family %s maxelem %d\n", tmp, st.Family, maxelem)
+		fmt.Fprintf(&b, "flush %s\n", tmp)
+		for _, e := range st.Entries {
+			fmt.Fprintf(&b, "add %s %s\n", tmp, e)
+		}
+		fmt.Fprintf(&b, "swap %s %s\ndestroy %s\n", tmp, st.Name, tmp)
+	}
+	return b.String()
+}
 
-func loadSysctlSnapshot() map[string]string {
-	b, err := os.ReadFile(sysctlSnapPath)
+func loadSets(sets []IPSet) error {
+	if len(sets) == 0 {
+		return nil
+	}
+	script := setScript(sets)
+	log.Tracef("ipset restore:\n%s", script)
+	out, err := runInput(script, "ipset", "-exist", "restore")
 	if err != nil {
-		return map[string]string{}
+		return fmt.Errorf("ipset restore: %v: %s", err, strings.TrimSpace(out))
 	}
-	var m map[string]string
-	if json.Unmarshal(b, &m) != nil {
-		return map[string]string{}
+	return nil
+}
+
+// destroySets removes the sets; it must run after the rules using them are
+// gone, or the kernel refuses.
+func destroySets(sets []IPSet) error {
+	var first error
+	for _, st := range sets {
+		if _, err := run("ipset", "list", "-n", st.Name); err != nil {
+			continue
+		}
+		if out, err := run("ipset", "destroy", st.Name); err != nil && first == nil {
+			first = fmt.Errorf("ipset destroy %s: %v: %s", st.Name, err, strings.TrimSpace(out))
+		}
 	}
-	return m
+	return first
 }
 
-func saveSysctlSnapshot(m map[string]string) {
-	b, _ := json.Marshal(m)
-	_ = os.WriteFile(sysctlSnapPath, b, 0600)
+func saveMangle(ipt string) (string, error) {
+	out, err := run(ipt+"-save", "-t", "mangle")
+	if err != nil {
+		return "", fmt.Errorf("%s-save: %v: %s", ipt, err, strings.TrimSpace(out))
+	}
+	return out, nil
 }
 
-func (s SysctlSetting) Apply() {
-	snap := loadSysctlSnapshot()
-	if _, ok := snap[s.Name]; !ok {
-		snap[s.Name] = getSysctlOrProc(s.Name)
-		saveSysctlSnapshot(snap)
+func restore(ipt, script string) error {
+	log.Tracef("%s-restore --noflush:\n%s", ipt, script)
+	out, err := runInput(script, ipt+"-restore", "-w", "--noflush")
+	if err != nil {
+		return fmt.Errorf("%s-restore: %v: %s", ipt, err, strings.TrimSpace(out))
 	}
-	setSysctlOrProc(s.Name, s.Desired)
+	return nil
 }
 
-func (s SysctlSetting) RevertBack() {
-	snap := loadSysctlSnapshot()
-	if v, ok := snap[s.Name]; ok && v != "" {
-		setSysctlOrProc(s.Name, v)
-		delete(snap, s.Name)
-		saveSysctlSnapshot(snap)
-		return
+// owned reports whether an iptables-save line is a b4 rule outside the B4
+// chain: tagged with commentTag, or an untagged jump left by older versions.
+func owned(line string) bool {
+	if !strings.HasPrefix(line, "-A ") || strings.HasPrefix(line, "-A B4 ") {
+		return false
 	}
-	setSysctlOrProc(s.Name, s.Revert)
+	line += " "
+	return strings.Contains(line, " --comment "+commentTag+" ") || strings.Contains(line, " -j B4 ")
 }
 
-type Manifest struct {
-	Chains  []Chain
-	Rules   []Rule
-	Sysctls []SysctlSetting
+// staleLines turns the b4 rules found in iptables-save output into -D
+// commands and reports whether the B4 chain exists.
+func staleLines(current string) ([]string, bool) {
+	var del []string
+	hasChain := false
+	for _, line := range strings.Split(current, "\n") {
+		line = strings.TrimSpace(line)
+		if strings.HasPrefix(line, ":B4 ") {
+			hasChain = true
+		}
+		if owned(line) {
+			del = append(del, "-D"+line[2:])
+		}
+	}
+	return del, hasChain
 }
 
-func (m Manifest) Apply() error {
+// restoreScript renders the transaction that replaces the b4 rules of one
+// family. current is the iptables-save -t mangle output; its b4 rules are
+// deleted and the B4 chain is flushed by redeclaring it.
+func restoreScript(ipt string, m Manifest, current string) string {
+	var b strings.Builder
+	b.WriteString("*mangle\n")
 	for _, c := range m.Chains {
-		c.Ensure()
+		if c.IPT == ipt {
+			fmt.Fprintf(&b, ":%s - [0:0]\n", c.Name)
+		}
+	}
+	del, _ := staleLines(current)
+	for _, l := range del {
+		b.WriteString(l + "\n")
 	}
 	for _, r := range m.Rules {
-		if err := r.Apply(); err != nil {
-			return err
+		if r.IPT == ipt {
+			b.WriteString(r.line() + "\n")
 		}
 	}
-	for _, s := range m.Sysctls {
-		s.Apply()
-	}
-	return nil
+	b.WriteString("COMMIT\n")
+	return b.String()
 }
 
-func (m Manifest) RemoveRules() {
-	for i := len(m.Rules) - 1; i >= 0; i-- {
-		m.Rules[i].Remove()
+// removeScript renders the transaction that deletes every b4 rule and the
+// B4 chain, or "" when there is nothing to remove.
+func removeScript(current string) string {
+	del, hasChain := staleLines(current)
+	if len(del) == 0 && !hasChain {
+		return ""
 	}
+	var b strings.Builder
+	b.WriteString("*mangle\n")
+	for _, l := range del {
+		b.WriteString(l + "\n")
+	}
+	if hasChain {
+		b.WriteString("-F B4\n-X B4\n")
+	}
+	b.WriteString("COMMIT\n")
+	return b.String()
 }
 
-func (m Manifest) RemoveChains() {
-	for i := len(m.Chains) - 1; i >= 0; i-- {
-		m.Chains[i].Remove()
+// Remove deletes exactly the rules and chains of m that are still
+// installed, one transaction per family. It is used to revert a journaled
+// manifest after a crash, when the current config may differ.
+func (m Manifest) Remove() error {
+	var first error
+	for _, ipt := range m.families() {
+		var b strings.Builder
+		for _, r := range m.Rules {
+			if r.IPT == ipt && existsRule(r.IPT, r.Table, r.Chain, r.Spec) {
+				b.WriteString(r.command("-D") + "\n")
+			}
+		}
+		for _, c := range m.Chains {
+			if c.IPT == ipt && existsChain(c.IPT, c.Table, c.Name) {
+				fmt.Fprintf(&b, "-F %s\n-X %s\n", c.Name, c.Name)
+			}
+		}
+		if b.Len() == 0 {
+			continue
+		}
+		if err := restore(ipt, "*mangle\n"+b.String()+"COMMIT\n"); err != nil && first == nil {
+			first = err
+		}
+	}
+	if err := destroySets(m.Sets); err != nil && first == nil {
+		first = err
 	}
+	return first
 }
 
-func (m Manifest) RevertSysctls() {
-	for _, s := range m.Sysctls {
-		s.RevertBack()
+func removeFamily(ipt string) error {
+	cur, err := saveMangle(ipt)
+	if err != nil {
+		return err
+	}
+	script := removeScript(cur)
+	if script == "" {
+		return nil
 	}
+	return restore(ipt, script)
 }
 
 func hasBinary(name string) bool {
-	_, err := run("sh", "-c", "command -v "+name)
+	_, err := exec.LookPath(name)
 	return err == nil
 }
 
+// Script renders m as the iptables-restore input AddRules feeds each family,
+// as it would look on a system without previous b4 rules.
+func (m Manifest) Script() string {
+	var b strings.Builder
+	if len(m.Sets) > 0 {
+		b.WriteString("# ipset -exist restore\n")
+		b.WriteString(setScript(m.Sets))
+	}
+	for _, ipt := range m.families() {
+		fmt.Fprintf(&b, "# %s-restore --noflush\n", ipt)
+		b.WriteString(restoreScript(ipt, m, ""))
+	}
+	for _, s := range m.Sysctls {
+		fmt.Fprintf(&b, "# sysctl %s=%s\n", s.Name, s.Desired)
+	}
+	return b.String()
+}
+
+// Plan builds the manifest for cfg; it is journaled so a crashed run
+// can remove exactly these rules.
+func Plan(cfg *config.Config) Manifest {
+	return buildManifest(cfg)
+}
+
 func buildManifest(cfg *config.Config) Manifest {
 	var ipts []string
 	if hasBinary("iptables") {
@@ -208,30 +431,65 @@ func buildManifest(cfg *config.Config) Manifest {
 	}
 	start := cfg.QueueStartNum
 	end := cfg.QueueStartNum + cfg.Threads - 1
-	lanIf := "br0"
-	wanIf := "eth0"
 	markHex := fmt.Sprintf("0x%x/0xffffffff", cfg.Mark)
 
 	var chains []Chain
 	var rules []Rule
+	var sets []IPSet
+	if len(cfg.TargetIPs) > 0 {
+		sets = targetSets(cfg.TargetIPs)
+	}
+	if cfg.LearnIPs {
+		sets = append(sets, learnedSets(cfg.LearnTTL, cfg.LearnMax)...)
+	}
 
 	for _, ipt := range ipts {
 		b4 := Chain{IPT: ipt, Table: "mangle", Name: "B4"}
 		chains = append(chains, b4)
 
-		tcpRule := Rule{
-			IPT: ipt, Table: "mangle", Chain: "B4", Action: "A",
-			Spec: append([]string{"-p", "tcp", "--dport", "443", "-m", "mark", "!", "--mark", markHex, "-m", "connbytes", "--connbytes-dir", "original", "--connbytes-mode", "packets", "--connbytes", "0:19"}, qbSpec(start, end)...),
+		var queueRules []Rule
+		for _, dst := range setSpecs(sets, ipt) {
+			queueRules = append(queueRules, Rule{
+				IPT: ipt, Table: "mangle", Chain: "B4", Action: "A",
+				Spec: concat(portSpec("tcp", cfg.TCPPorts), dst, []string{"-m", "mark", "!", "--mark", markHex}, connbytesSpec(cfg.ConnBytesLimit), qbSpec(start, end)),
+			})
+		}
+		for _, dst := range setSpecs(sets, ipt) {
+			queueRules = append(queueRules, Rule{
+				IPT: ipt, Table: "mangle", Chain: "B4", Action: "A",
+				Spec: concat(portSpec("udp", cfg.UDPPorts), dst, []string{"-m", "mark", "!", "--mark", markHex}, connbytesSpec(cfg.UDPConnBytesLimit), qbSpec(start, end)),
+			})
 		}
-		udpRule := Rule{
-			IPT: ipt, Table: "mangle", Chain: "B4", Action: "A",
-			Spec: append([]string{"-p", "udp", "--dport", "443", "-m", "mark", "!", "--mark", markHex, "-m", "connbytes", "--connbytes-dir", "original", "--connbytes-mode", "packets", "--connbytes", "0:8"}, qbSpec(start, end)...),
+
+		// Split connections are queued by connmark, replies included.
+		var ctRules []Rule
+		if cfg.SplitsRecords() {
+			ctMark := []string{"-m", "connmark", "--mark", markHex}
+			queueRules = append([]Rule{{
+				IPT: ipt, Table: "mangle", Chain: "B4", Action: "A",
+				Spec: concat(portSpec("tcp", cfg.TCPPorts), []string{"-m", "mark", "!", "--mark", markHex}, ctMark, qbSpec(start, end)),
+			}}, queueRules...)
+			chains := []string{"INPUT"}
+			if !cfg.OutputOnly {
+				chains = append(chains, "FORWARD")
+			}
+			for _, chain := range chains {
+				ctRules = append(ctRules, Rule{IPT: ipt, Table: "mangle", Chain: chain, Action: "A",
+					Spec: concat(srcPortSpec("tcp", cfg.TCPPorts), ctMark, []string{"-m", "comment", "--comment", commentTag}, qbSpec(start, end))})
+			}
 		}
 
-		jumpPrerouting := Rule{IPT: ipt, Table: "mangle", Chain: "PREROUTING", Action: "A", Spec: []string{"-i", lanIf, "-m", "mark", "!", "--mark", markHex, "-j", "B4"}}
-		jumpPostrouting := Rule{IPT: ipt, Table: "mangle", Chain: "POSTROUTING", Action: "A", Spec: []string{"-o", wanIf, "-m", "mark", "!", "--mark", markHex, "-j", "B4"}}
-		jumpOutputTCP := Rule{IPT: ipt, Table: "mangle", Chain: "OUTPUT", Action: "I", Spec: []string{"-p", "tcp", "--dport", "443", "-m", "mark", "!", "--mark", markHex, "-j", "B4"}}
-		jumpOutputUDP := Rule{IPT: ipt, Table: "mangle", Chain: "OUTPUT", Action: "I", Spec: []string{"-p", "udp", "--dport", "443", "-m", "mark", "!", "--mark", markHex, "-j", "B4"}}
+		var jumps []Rule
+		if !cfg.OutputOnly {
+			for _, lanIf := range cfg.LANIfaces {
+				jumps = append(jumps, Rule{IPT: ipt, Table: "mangle", Chain: "PREROUTING", Action: "A", Spec: []string{"-i", lanIf, "-m", "mark", "!", "--mark", markHex, "-m", "comment", "--comment", commentTag, "-j", "B4"}})
+			}
+			for _, wanIf := range cfg.WANIfaces {
+				jumps = append(jumps, Rule{IPT: ipt, Table: "mangle", Chain: "POSTROUTING", Action: "A", Spec: []string{"-o", wanIf, "-m", "mark", "!", "--mark", markHex, "-m", "comment", "--comment", commentTag, "-j", "B4"}})
+			}
+		}
+		jumpOutputTCP := Rule{IPT: ipt, Table: "mangle", Chain: "OUTPUT", Action: "I", Spec: concat(portSpec("tcp", cfg.TCPPorts), []string{"-m", "mark", "!", "--mark", markHex, "-m", "comment", "--comment", commentTag, "-j", "B4"})}
+		jumpOutputUDP := Rule{IPT: ipt, Table: "mangle", Chain: "OUTPUT", Action: "I", Spec: concat(portSpec("udp", cfg.UDPPorts), []string{"-m", "mark", "!", "--mark", markHex, "-m", "comment", "--comment", commentTag, "-j", "B4"})}
 
 		if existsChain(ipt, "mangle", "DIVERT") {
 			divertReturnHTTPS := Rule{
@@ -239,39 +497,66 @@ func buildManifest(cfg *config.Config) Manifest {
 				Table:  "mangle",
 				Chain:  "DIVERT",
 				Action: "I",
-				Spec:   []string{"-p", "tcp", "--dport", "443", "-j", "RETURN"},
+				Spec:   concat(portSpec("tcp", cfg.TCPPorts), []string{"-m", "comment", "--comment", commentTag, "-j", "RETURN"}),
 			}
 			rules = append(rules, divertReturnHTTPS)
 		}
 
-		rules = append(rules, jumpPrerouting, jumpPostrouting, jumpOutputTCP, jumpOutputUDP, tcpRule, udpRule)
+		rules = append(rules, jumps...)
+		rules = append(rules, ctRules...)
+		rules = append(rules, jumpOutputTCP, jumpOutputUDP)
+		rules = append(rules, queueRules...)
 	}
 
-	sysctls := []SysctlSetting{
-		{Name: "net.netfilter.nf_conntrack_checksum", Desired: "0", Revert: "1"},
-		{Name: "net.netfilter.nf_conntrack_tcp_be_liberal", Desired: "1", Revert: "0"},
+	return Manifest{Chains: chains, Rules: rules, Sets: sets, Sysctls: sysctl.Conntrack}
+}
+
+const (
+	targetSet4  = "b4_target4"
+	targetSet6  = "b4_target6"
+	learnedSet4 = "b4_learned4"
+	learnedSet6 = "b4_learned6"
+)
+
+// targetSets splits TargetIPs into an ipset per family.
+func targetSets(prefixes []netip.Prefix) []IPSet {
+	v4 := IPSet{Name: targetSet4, Family: "inet"}
+	v6 := IPSet{Name: targetSet6, Family: "inet6"}
+	for _, p := range prefixes {
+		p = cidr.Unmap(p)
+		if p.Addr().Is4() {
+			v4.Entries = append(v4.Entries, p.String())
+		} else {
+			v6.Entries = append(v6.Entries, p.String())
+		}
 	}
+	return []IPSet{v4, v6}
+}
 
-	return Manifest{Chains: chains, Rules: rules, Sysctls: sysctls}
+func learnedSets(ttl, maxElem int) []IPSet {
+	return []IPSet{
+		{Name: learnedSet4, Family: "inet", Timeout: ttl, MaxElem: maxElem},
+		{Name: learnedSet6, Family: "inet6", Timeout: ttl, MaxElem: maxElem},
+	}
 }
 
-func delAnyJumpToB4(ipt, chain string) {
-	out, _ := run(ipt, "-w", "-t", "mangle", "-S", chain)
-	for _, line := range strings.Split(out, "\n") {
-		line = strings.TrimSpace(line)
-		if !(strings.HasPrefix(line, "-A "+chain+" ") || strings.HasPrefix(line, "-I "+chain+" ")) {
-			continue
-		}
-		if !strings.Contains(line, "-j B4") {
-			continue
-		}
-		fields := strings.Fields(line)
-		if len(fields) < 3 {
-			continue
+// setSpecs returns one destination match per set of the ipt family; a queue
+// rule is installed for each. Without sets there is a single empty match.
+func setSpecs(sets []IPSet, ipt string) [][]string {
+	if len(sets) == 0 {
+		return [][]string{nil}
+	}
+	family := "inet"
+	if ipt == "ip6tables" {
+		family = "inet6"
+	}
+	var out [][]string
+	for _, st := range sets {
+		if st.Family == family {
+			out = append(out, []string{"-m", "set", "--match-set", st.Name, "dst"})
 		}
-		spec := fields[2:]
-		_, _ = run(append([]string{ipt, "-w", "-t", "mangle", "-D", chain}, spec...)...)
 	}
+	return out
 }
 
 func AddRules(cfg *config.Config) error {
@@ -283,29 +568,55 @@ func AddRules(cfg *config.Config) error {
 	return m.Apply()
 }
 
+// Verify reports the first rule of the manifest that is no longer installed,
+// e.g. after the system firewall was reloaded.
+func Verify(cfg *config.Config) error {
+	return buildManifest(cfg).verify()
+}
+
 func ClearRules(cfg *config.Config) error {
 	if cfg.SkipIpTables {
 		return nil
 	}
-	ipts := []string{}
-	if hasBinary("iptables") {
-		ipts = append(ipts, "iptables")
+	m := buildManifest(cfg)
+	var first error
+	for _, ipt := range m.families() {
+		if err := removeFamily(ipt); err != nil {
+			log.Errorf("IPTABLES: clear %s: %v", ipt, err)
+			if first == nil {
+				first = err
+			}
+		}
 	}
-	if hasBinary("ip6tables") {
-		ipts = append(ipts, "ip6tables")
+	// The sets of a previous config may differ in contents, never in names.
+	if err := destroySets(append(targetSets(nil), learnedSets(0, 0)...)); err != nil {
+		log.Errorf("IPTABLES: clear: %v", err)
+		if first == nil {
+			first = err
+		}
 	}
-	if len(ipts) == 0 {
-		ipts = []string{"iptables"}
+	m.RevertSysctls()
+	return first
+}
+
+// Learn adds a server address to the learned set of its family, or renews
+// its timeout when it is already there.
+func Learn(addr netip.Addr) error {
+	name := learnedSet4
+	if !addr.Is4() {
+		name = learnedSet6
 	}
-	m := buildManifest(cfg)
-	m.RemoveRules()
-	for _, ipt := range ipts {
-		delAnyJumpToB4(ipt, "PREROUTING")
-		delAnyJumpToB4(ipt, "POSTROUTING")
-		delAnyJumpToB4(ipt, "OUTPUT")
+	out, err := run("ipset", "-exist", "add", name, addr.String())
+	if err != nil {
+		return fmt.Errorf("ipset add %s %s: %v: %s", name, addr, err, strings.TrimSpace(out))
 	}
-	time.Sleep(30 * time.Millisecond)
-	m.RemoveChains()
-	m.RevertSysctls()
 	return nil
 }
+
+// LoadTargets replaces the contents of the target sets after a reload.
+func LoadTargets(cfg *config.Config) error {
+	if cfg.SkipIpTables || len(cfg.TargetIPs) == 0 {
+		return nil
+	}
+	return loadSets(targetSets(cfg.TargetIPs))
+}
@@ -0,0 +1,197 @@
+package iptables
+
+import (
+	"net/netip"
+	"slices"
+	"testing"
+)
+
+// saveDump is iptables-save -t mangle output with b4 rules mixed in among
+// rules of the system firewall.
+const saveDump = `# Generated by iptables-save v1.8.10 on Fri Oct 16 12:00:00 2026
+*mangle
+:PREROUTING ACCEPT [0:0]
+:INPUT ACCEPT [0:0]
+:FORWARD ACCEPT [0:0]
+:OUTPUT ACCEPT [0:0]
+:POSTROUTING ACCEPT [0:0]
+:B4 - [0:0]
+:fw_mangle - [0:0]
+-A PREROUTING -j fw_mangle
+-A PREROUTING -i br-lan -m mark ! --mark 0x8000/0xffffffff -m comment --comment b4 -j B4
+-A FORWARD -p tcp -m tcp --tcp-flags SYN,RST SYN -j TCPMSS --clamp-mss-to-pmtu
+-A OUTPUT -p tcp -m tcp --dport 443 -m comment --comment b4-not-ours -j ACCEPT
+-A OUTPUT -p udp -m udp --dport 443 -j B4
+-A POSTROUTING -o wan -m comment --comment "b4 lookalike" -j MARK --set-xmark 0x1/0xff
+-A B4 -p tcp -m tcp --dport 443 -j NFQUEUE --queue-num 537 --queue-bypass
+-A fw_mangle -m comment --comment b4 -j RETURN
+COMMIT
+# Completed on Fri Oct 16 12:00:00 2026
+`
+
+func TestOwned(t *testing.T) {
+	tests := []struct {
+		line string
+		want bool
+	}{
+		{"-A PREROUTING -i br-lan -m mark ! --mark 0x8000/0xffffffff -m comment --comment b4 -j B4", true},
+		{"-A OUTPUT -p udp -m udp --dport 443 -j B4", true},
+		{"-A fw_mangle -m comment --comment b4 -j RETURN", true},
+		{"-A B4 -p tcp -m tcp --dport 443 -j NFQUEUE --queue-num 537 --queue-bypass", false},
+		{"-A OUTPUT -p tcp -m tcp --dport 443 -m comment --comment b4-not-ours -j ACCEPT", false},
+		{`-A POSTROUTING -o wan -m comment --comment "b4 lookalike" -j MARK --set-xmark 0x1/0xff`, false},
+		{"-A PREROUTING -j fw_mangle", false},
+		{":B4 - [0:0]", false},
+		{"", false},
+	}
+	for _, tt := range tests {
+		if got := owned(tt.line); got != tt.want {
+			t.Errorf("owned(%q) = %t, want %t", tt.line, got, tt.want)
+		}
+	}
+}
+
+func TestStaleLines(t *testing.T) {
+	del, hasChain := staleLines(saveDump)
+	want := []string{
+		"-D PREROUTING -i br-lan -m mark ! --mark 0x8000/0xffffffff -m comment --comment b4 -j B4",
+		"-D OUTPUT -p udp -m udp --dport 443 -j B4",
+		"-D fw_mangle -m comment --comment b4 -j RETURN",
+	}
+	if !slices.Equal(del, want) || !hasChain {
+		t.Errorf("staleLines = %q, %t\nwant %q, true", del, hasChain, want)
+	}
+
+	del, hasChain = staleLines("*mangle\n:PREROUTING ACCEPT [0:0]\n-A PREROUTING -j fw_mangle\nCOMMIT\n")
+	if len(del) != 0 || hasChain {
+		t.Errorf("staleLines of a foreign dump = %q, %t", del, hasChain)
+	}
+}
+
+func testManifest() Manifest {
+	var m Manifest
+	for _, ipt := range []string{"iptables", "ip6tables"} {
+		m.Chains = append(m.Chains, Chain{IPT: ipt, Table: "mangle", Name: "B4"})
+		m.Rules = append(m.Rules,
+			Rule{IPT: ipt, Table: "mangle", Chain: "POSTROUTING", Action: "A",
+				Spec: []string{"-o", "wan", "-m", "comment", "--comment", commentTag, "-j", "B4"}},
+			Rule{IPT: ipt, Table: "mangle", Chain: "OUTPUT", Action: "I",
+				Spec: []string{"-p", "tcp", "--dport", "443", "-m", "comment", "--comment", commentTag, "-j", "B4"}},
+			Rule{IPT: ipt, Table: "mangle", Chain: "B4", Action: "A",
+				Spec: concat([]string{"-p", "tcp", "--dport", "443"}, qbSpec(537, 540))},
+		)
+	}
+	m.Rules = append(m.Rules, Rule{IPT: "ip6tables", Table: "mangle", Chain: "B4", Action: "A",
+		Spec: []string{"-m", "comment", "--comment", "two words", "-j", "RETURN"}})
+	return m
+}
+
+func TestRestoreScript(t *testing.T) {
+	m := testManifest()
+	tests := []struct {
+		name    string
+		ipt     string
+		current string
+		want    string
+	}{
+		{
+			name: "fresh",
+			ipt:  "iptables",
+			want: `*mangle
+:B4 - [0:0]
+-A POSTROUTING -o wan -m comment --comment b4 -j B4
+-I OUTPUT -p tcp --dport 443 -m comment --comment b4 -j B4
+-A B4 -p tcp --dport 443 -j NFQUEUE --queue-balance 537:540 --queue-bypass
+COMMIT
+`,
+		},
+		{
+			name:    "replacing previous rules",
+			ipt:     "iptables",
+			current: saveDump,
+			want: `*mangle
+:B4 - [0:0]
+-D PREROUTING -i br-lan -m mark ! --mark 0x8000/0xffffffff -m comment --comment b4 -j B4
+-D OUTPUT -p udp -m udp --dport 443 -j B4
+-D fw_mangle -m comment --comment b4 -j RETURN
+-A POSTROUTING -o wan -m comment --comment b4 -j B4
+-I OUTPUT -p tcp --dport 443 -m comment --comment b4 -j B4
+-A B4 -p tcp --dport 443 -j NFQUEUE --queue-balance 537:540 --queue-bypass
+COMMIT
+`,
+		},
+		{
+			name: "other family",
+			ipt:  "ip6tables",
+			want: `*mangle
+:B4 - [0:0]
+-A POSTROUTING -o wan -m comment --comment b4 -j B4
+-I OUTPUT -p tcp --dport 443 -m comment --comment b4 -j B4
+-A B4 -p tcp --dport 443 -j NFQUEUE --queue-balance 537:540 --queue-bypass
+-A B4 -m comment --comment "two words" -j RETURN
+COMMIT
+`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := restoreScript(tt.ipt, m, tt.current); got != tt.want {
+				t.Errorf("got:\n%s\nwant:\n%s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRemoveScript(t *testing.T) {
+	tests := []struct {
+		name    string
+		current string
+		want    string
+	}{
+		{
+			name:    "rules and chain",
+			current: saveDump,
+			want: `*mangle
+-D PREROUTING -i br-lan -m mark ! --mark 0x8000/0xffffffff -m comment --comment b4 -j B4
+-D OUTPUT -p udp -m udp --dport 443 -j B4
+-D fw_mangle -m comment --comment b4 -j RETURN
+-F B4
+-X B4
+COMMIT
+`,
+		},
+		{
+			name:    "chain only",
+			current: "*mangle\n:OUTPUT ACCEPT [0:0]\n:B4 - [0:0]\nCOMMIT\n",
+			want:    "*mangle\n-F B4\n-X B4\nCOMMIT\n",
+		},
+		{
+			name:    "nothing of ours",
+			current: "*mangle\n:OUTPUT ACCEPT [0:0]\n-A OUTPUT -j ACCEPT\nCOMMIT\n",
+		},
+		{
+			name: "empty",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := removeScript(tt.current); got != tt.want {
+				t.Errorf("got:\n%s\nwant:\n%s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTargetSets(t *testing.T) {
+	var prefixes []netip.Prefix
+	for _, s := range []string{"192.0.2.0/24", "::ffff:198.51.100.0/120", "2001:db8::/32", "::ffff:0:0/95"} {
+		prefixes = append(prefixes, netip.MustParsePrefix(s))
+	}
+	sets := targetSets(prefixes)
+	if want := []string{"192.0.2.0/24", "198.51.100.0/24"}; !slices.Equal(sets[0].Entries, want) {
+		t.Errorf("v4 entries %q, want %q", sets[0].Entries, want)
+	}
+	if want := []string{"2001:db8::/32", "::ffff:0.0.0.0/95"}; !slices.Equal(sets[1].Entries, want) {
+		t.Errorf("v6 entries %q, want %q", sets[1].Entries, want)
+	}
+}
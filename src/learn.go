@@ -0,0 +1,147 @@
+package main
+
+import (
+	"net/netip"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/daniellavrushin/b4/config"
+	"github.com/daniellavrushin/b4/log"
+	"github.com/daniellavrushin/b4/sni"
+)
+
+// learner adds the servers of target hosts seen by the sniffers to the
+// learned firewall sets, so their next connections are queued. It remembers
+// what it added until the set timeout runs out, which keeps a busy server to
+// one set update per TTL instead of one per connection. The set updates
+// run on a worker of their own, so the sniffers never wait for them.
+type learner struct {
+	cfg     *config.Config
+	ttl     time.Duration
+	matcher atomic.Pointer[sni.Matcher]
+
+	mu    sync.Mutex
+	until map[netip.Addr]time.Time
+	count [2]int // entries of until per family, IPv4 then IPv6, for LearnMax
+
+	queue chan learnReq
+	stop  chan struct{}
+	done  chan struct{}
+}
+
+type learnReq struct {
+	addr netip.Addr
+	host string
+}
+
+// learnQueueLen bounds the set updates waiting for the worker; more are
+// dropped and learned from a later connection.
+const learnQueueLen = 256
+
+func newLearner(cfg *config.Config) *learner {
+	return &learner{
+		cfg:   cfg,
+		ttl:   time.Duration(cfg.LearnTTL) * time.Second,
+		until: make(map[netip.Addr]time.Time),
+		queue: make(chan learnReq, learnQueueLen),
+		stop:  make(chan struct{}),
+		done:  make(chan struct{}),
+	}
+}
+
+func (l *learner) Run() {
+	go func() {
+		defer close(l.done)
+		for {
+			select {
+			case <-l.stop:
+				return
+			case r := <-l.queue:
+				l.add(r)
+			}
+		}
+	}()
+}
+
+// Close stops the worker and waits for an update in progress, so no address
+// is added after shutdown removed the sets.
+func (l *learner) Close() {
+	close(l.stop)
+	<-l.done
+}
+
+// SetMatcher follows the sniffers' matcher. Without one the sniffers report
+// every host, so nothing is learned.
+func (l *learner) SetMatcher(m *sni.Matcher) {
+	l.matcher.Store(m)
+}
+
+func (l *learner) Learn(ft sni.FiveTuple, host string) {
+	if l.matcher.Load() == nil {
+		return
+	}
+	addr := ft.Dst()
+	fam := family(addr)
+	now := time.Now()
+	l.mu.Lock()
+	t, known := l.until[addr]
+	if known && now.Before(t) {
+		l.mu.Unlock()
+		return
+	}
+	if !known {
+		if l.count[fam] >= l.cfg.LearnMax {
+			for a, t := range l.until {
+				if !now.Before(t) {
+					l.deleteLocked(a)
+				}
+			}
+		}
+		if l.count[fam] >= l.cfg.LearnMax {
+			l.mu.Unlock()
+			log.Tracef("learn: %s (%s) skipped, set full", addr, host)
+			return
+		}
+		l.count[fam]++
+	}
+	l.until[addr] = now.Add(l.ttl)
+	l.mu.Unlock()
+
+	select {
+	case l.queue <- learnReq{addr, host}:
+	default:
+		log.Tracef("learn: %s (%s) dropped, queue full", addr, host)
+		l.forget(addr)
+	}
+}
+
+func (l *learner) add(r learnReq) {
+	if err := learnAddr(l.cfg, r.addr); err != nil {
+		log.Errorf("learn: %v", err)
+		l.forget(r.addr)
+		return
+	}
+	log.Infof("learn: queueing %s for %s", r.addr, r.host)
+}
+
+func (l *learner) forget(addr netip.Addr) {
+	l.mu.Lock()
+	if _, ok := l.until[addr]; ok {
+		l.deleteLocked(addr)
+	}
+	l.mu.Unlock()
+}
+
+func (l *learner) deleteLocked(addr netip.Addr) {
+	delete(l.until, addr)
+	l.count[family(addr)]--
+}
+
+// family indexes count like the learned sets: IPv4, then IPv6.
+func family(addr netip.Addr) int {
+	if addr.Is4() {
+		return 0
+	}
+	return 1
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"net/netip"
+	"testing"
+
+	"github.com/daniellavrushin/b4/config"
+	"github.com/daniellavrushin/b4/sni"
+)
+
+func tuple(addr string) sni.FiveTuple {
+	a := netip.MustParseAddr(addr)
+	return sni.FiveTuple{V6: !a.Is4(), DstIP: a.As16()}
+}
+
+func TestLearnMaxPerFamily(t *testing.T) {
+	cfg := config.DefaultConfig
+	cfg.LearnMax = 2
+	l := newLearner(&cfg)
+	l.SetMatcher(sni.NewMatcher())
+
+	for _, a := range []string{"192.0.2.1", "192.0.2.2", "192.0.2.3", "2001:db8::1", "2001:db8::2", "2001:db8::3", "192.0.2.1"} {
+		l.Learn(tuple(a), "example.com")
+	}
+	if l.count != [2]int{2, 2} || len(l.until) != 4 {
+		t.Fatalf("counts %v with %d entries, want 2 per family", l.count, len(l.until))
+	}
+	if _, ok := l.until[netip.MustParseAddr("192.0.2.3")]; ok {
+		t.Error("third IPv4 address learned")
+	}
+
+	l.forget(netip.MustParseAddr("192.0.2.1"))
+	l.forget(netip.MustParseAddr("192.0.2.9"))
+	l.Learn(tuple("192.0.2.3"), "example.com")
+	if _, ok := l.until[netip.MustParseAddr("192.0.2.3")]; !ok || l.count != [2]int{2, 2} {
+		t.Errorf("after forget: counts %v, 192.0.2.3 learned %t", l.count, ok)
+	}
+}
@@ -9,31 +9,71 @@ import (
 	"time"
 
 	"github.com/daniellavrushin/b4/config"
-	"github.com/daniellavrushin/b4/iptables"
 	"github.com/daniellavrushin/b4/log"
+	"github.com/daniellavrushin/b4/mangle"
+	"github.com/daniellavrushin/b4/nfq"
 	"github.com/daniellavrushin/b4/sni"
 )
 
 func main() {
+	args := os.Args[1:]
+	if len(args) >= 2 && args[0] == "config" && args[1] == "dump" {
+		os.Exit(runConfigDump(args[2:]))
+	}
+	if len(args) >= 1 && args[0] == "cleanup" {
+		os.Exit(runCleanup(args[1:]))
+	}
+	if len(args) >= 1 && args[0] == "rules" {
+		os.Exit(runRules(args[1:]))
+	}
+
 	cfg := config.DefaultConfig
-	if _, err := cfg.ParseArgs(os.Args[1:]); err != nil {
+	log.Init(os.Stderr, log.Level(cfg.Logging.Level), cfg.Logging.Instaflush)
+	if _, err := cfg.ParseArgs(args); err != nil {
+		log.Flush()
 		os.Exit(1)
 	}
 	initLogging(&cfg)
 	log.Infof("starting B4...")
 	log.Infof("Running with flags: %s", flagsSummary(os.Args[1:]))
 
+	if err := openState(&cfg); err != nil {
+		log.Errorf("state: %v", err)
+		log.Flush()
+		os.Exit(1)
+	}
+
+	resolveFirewall(&cfg)
+	if cfg.OutputOnly {
+		log.Infof("firewall: %s, OUTPUT only", cfg.Firewall)
+	} else {
+		log.Infof("firewall: %s, LAN %v, WAN %v", cfg.Firewall, cfg.LANIfaces, cfg.WANIfaces)
+	}
+	writeJournal(&cfg)
 	if !cfg.SkipIpTables {
-		iptables.ClearRules(&cfg)
-		if err := iptables.AddRules(&cfg); err != nil {
-			log.Errorf("failed to add iptables rules: %v", err)
+		clearRules(&cfg)
+		if err := addRules(&cfg); err != nil {
+			log.Errorf("failed to add firewall rules: %v", err)
+			teardown(&cfg)
 			os.Exit(1)
 		}
 	}
 
-	var matcher *sni.SuffixSet
-	if len(cfg.SNIDomains) > 0 {
-		matcher = sni.NewSuffixSet(cfg.SNIDomains)
+	pool := nfq.NewPool(&cfg)
+	if err := pool.Start(); err != nil {
+		log.Errorf("failed to start NFQUEUE workers: %v", err)
+		teardown(&cfg)
+		os.Exit(1)
+	}
+
+	matcher := newMatcher(&cfg)
+	onHost := func(ft sni.FiveTuple, host string) {}
+	var learn *learner
+	if cfg.LearnIPs && !cfg.SkipIpTables {
+		learn = newLearner(&cfg)
+		learn.SetMatcher(matcher)
+		learn.Run()
+		onHost = learn.Learn
 	}
 
 	var ifaces []string
@@ -61,8 +101,12 @@ func main() {
 			MaxClientHelloBytes: 8192,
 			Promisc:             true,
 			Matcher:             matcher,
-			OnTLSHost:           func(ft sni.FiveTuple, host string) {},
-			OnQUICHost:          func(ft sni.FiveTuple, host string) {},
+			TCPPorts:            cfg.TCPPorts,
+			UDPPorts:            cfg.UDPPorts,
+			TCPPackets:          cfg.ConnBytesLimit,
+			OnTLSHost:           onHost,
+			OnQUICHost:          onHost,
+			OnSynAck:            mangle.ObserveServerTTL,
 		})
 		if err != nil {
 			log.Errorf("AF_PACKET start failed on %s: %v", name, err)
@@ -74,25 +118,99 @@ func main() {
 	}
 	if len(sniffers) == 0 {
 		log.Errorf("no interfaces to sniff")
+		pool.Stop()
+		teardown(&cfg)
 		os.Exit(1)
 	}
 
+	var watchdog *ruleWatchdog
+	if !cfg.SkipIpTables && cfg.WatchdogInterval > 0 {
+		watchdog = newRuleWatchdog()
+		watchdog.Run(&cfg, time.Duration(cfg.WatchdogInterval)*time.Second)
+	}
+
+	cur := &cfg
+	reload := func(reason string) {
+		next, err := reloadConfig(args, cur)
+		if err != nil {
+			log.Errorf("reload (%s) failed, keeping current config: %v", reason, err)
+			return
+		}
+		pool.Reload(next)
+		m := newMatcher(next)
+		for _, sn := range sniffers {
+			sn.SetMatcher(m)
+		}
+		if learn != nil {
+			learn.SetMatcher(m)
+		}
+		log.SetLevel(log.Level(next.Logging.Level))
+		log.SetInstaflush(next.Logging.Instaflush)
+		if watchdog != nil {
+			watchdog.SetConfig(next)
+		}
+		cur = next
+		log.Infof("reloaded config (%s): %d domains, %d profiles", reason, len(next.SNIDomains), len(next.Profiles))
+	}
+
+	changed := make(chan struct{}, 1)
+	var watcher *fileWatcher
+	if cfg.WatchInterval > 0 {
+		watcher = newFileWatcher(cfg.WatchedFiles())
+		watcher.Run(time.Duration(cfg.WatchInterval)*time.Second, changed)
+	}
+
 	sig := make(chan os.Signal, 1)
-	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
-	<-sig
+	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+	for running := true; running; {
+		select {
+		case s := <-sig:
+			if s != syscall.SIGHUP {
+				running = false
+				break
+			}
+			reload("SIGHUP")
+		case <-changed:
+			reload("file change")
+		}
+		if watcher != nil {
+			watcher.SetFiles(cur.WatchedFiles())
+		}
+	}
+	if watcher != nil {
+		watcher.Close()
+	}
+	if watchdog != nil {
+		watchdog.Close()
+	}
 
 	for _, sn := range sniffers {
 		sn.Close()
 	}
-
-	if !cfg.SkipIpTables {
-		if err := iptables.ClearRules(&cfg); err != nil {
-			log.Errorf("failed to clear iptables rules: %v", err)
-		}
+	if learn != nil {
+		learn.Close()
 	}
+	pool.Stop()
+
+	teardown(&cfg)
 	log.Infof("bye")
 }
 
+func runConfigDump(args []string) int {
+	cfg := config.DefaultConfig
+	log.Init(os.Stderr, log.Level(cfg.Logging.Level), cfg.Logging.Instaflush)
+	if _, err := cfg.ParseArgs(args); err != nil {
+		log.Flush()
+		return 1
+	}
+	if err := cfg.Dump(os.Stdout); err != nil {
+		log.Errorf("config dump: %v", err)
+		log.Flush()
+		return 1
+	}
+	return 0
+}
+
 func initLogging(cfg *config.Config) error {
 	log.Init(os.Stderr, log.Level(cfg.Logging.Level), cfg.Logging.Instaflush)
 	if cfg.Logging.Syslog {
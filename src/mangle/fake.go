@@ -0,0 +1,155 @@
+package mangle
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+
+	"github.com/daniellavrushin/b4/config"
+	"github.com/daniellavrushin/b4/tlshello"
+)
+
+const (
+	extPadding  = 0x0015
+	extKeyShare = 0x0033
+
+	fakeRandomLen = 560
+)
+
+// fakePayload returns the TLS records of one fake ClientHello: the captured
+// hello of st, random bytes behind a handshake header, or a ClientHello for
+// the decoy SNI, padded to realLen when FakePad is set. Random, session ID
+// and key shares are fresh for every fake.
+func fakePayload(st *config.Strategy, realLen int) []byte {
+	var b []byte
+	switch {
+	case len(st.FakeHello) > 0:
+		b = append([]byte(nil), st.FakeHello...)
+	case st.FakeType == config.FakeTypeRandom:
+		b = make([]byte, fakeRandomLen)
+		b[0] = tlshello.ContentTypeHandshake
+		b[1], b[2] = 0x03, 0x01
+		binary.BigEndian.PutUint16(b[3:5], fakeRandomLen-5)
+		b[5] = tlshello.TypeClientHello
+		_, _ = rand.Read(b[6:])
+		return b
+	default:
+		size := 0
+		if st.FakePad {
+			size = realLen
+		}
+		b = buildClientHello(st.FakeSNI, size)
+	}
+	randomizeHello(b)
+	return b
+}
+
+// buildClientHello builds a single-record TLS 1.3 ClientHello for sni with
+// the extensions of a current browser. When size exceeds its natural length
+// a padding extension makes up the difference. Random, session ID and key
+// share are left zero for randomizeHello.
+func buildClientHello(sni string, size int) []byte {
+	var ext []byte
+	ext = appendExt(ext, tlshello.ExtServerName, func(b []byte) []byte {
+		b = binary.BigEndian.AppendUint16(b, uint16(len(sni)+3))
+		b = append(b, 0)
+		b = binary.BigEndian.AppendUint16(b, uint16(len(sni)))
+		return append(b, sni...)
+	})
+	// extended_master_secret, renegotiation_info, supported_groups,
+	// ec_point_formats, session_ticket
+	ext = appendExt(ext, 0x0017, nil)
+	ext = appendExt(ext, 0xff01, func(b []byte) []byte { return append(b, 0) })
+	ext = appendExt(ext, 0x000a, func(b []byte) []byte { return append(b, 0, 6, 0, 0x1d, 0, 0x17, 0, 0x18) })
+	ext = appendExt(ext, 0x000b, func(b []byte) []byte { return append(b, 1, 0) })
+	ext = appendExt(ext, 0x0023, nil)
+	ext = appendExt(ext, tlshello.ExtALPN, func(b []byte) []byte {
+		return append(b, 0, 12, 2, 'h', '2', 8, 'h', 't', 't', 'p', '/', '1', '.', '1')
+	})
+	// status_request, signature_algorithms, signed_certificate_timestamp
+	ext = appendExt(ext, 0x0005, func(b []byte) []byte { return append(b, 1, 0, 0, 0, 0) })
+	ext = appendExt(ext, 0x000d, func(b []byte) []byte {
+		return append(b, 0, 16, 4, 3, 8, 4, 4, 1, 5, 3, 8, 5, 5, 1, 8, 6, 6, 1)
+	})
+	ext = appendExt(ext, 0x0012, nil)
+	// one x25519 share
+	ext = appendExt(ext, extKeyShare, func(b []byte) []byte {
+		b = append(b, 0, 36, 0, 0x1d, 0, 32)
+		return append(b, make([]byte, 32)...)
+	})
+	// psk_key_exchange_modes, supported_versions (1.3, 1.2),
+	// compress_certificate
+	ext = appendExt(ext, 0x002d, func(b []byte) []byte { return append(b, 1, 1) })
+	ext = appendExt(ext, 0x002b, func(b []byte) []byte { return append(b, 4, 3, 4, 3, 3) })
+	ext = appendExt(ext, 0x001b, func(b []byte) []byte { return append(b, 2, 0, 2) })
+
+	suites := []byte{0x13, 0x01, 0x13, 0x02, 0x13, 0x03, 0xc0, 0x2b, 0xc0, 0x2f, 0xc0, 0x2c, 0xc0, 0x30,
+		0xcc, 0xa9, 0xcc, 0xa8, 0xc0, 0x13, 0xc0, 0x14, 0x00, 0x9c, 0x00, 0x9d, 0x00, 0x2f, 0x00, 0x35}
+
+	// record header, handshake header, version, random, session ID, suites,
+	// compression methods, extensions length
+	base := 5 + 4 + 2 + 32 + 1 + 32 + 2 + len(suites) + 2 + 2 + len(ext)
+	if pad := size - base - 4; pad >= 0 && size <= 5+0x4000 {
+		ext = appendExt(ext, extPadding, func(b []byte) []byte { return append(b, make([]byte, pad)...) })
+	}
+
+	b := make([]byte, 0, 5+4+2+32+1+32+2+len(suites)+2+2+len(ext))
+	b = append(b, tlshello.ContentTypeHandshake, 0x03, 0x01, 0, 0)
+	b = append(b, tlshello.TypeClientHello, 0, 0, 0)
+	b = append(b, 0x03, 0x03)
+	b = append(b, make([]byte, 32)...)
+	b = append(b, 32)
+	b = append(b, make([]byte, 32)...)
+	b = binary.BigEndian.AppendUint16(b, uint16(len(suites)))
+	b = append(b, suites...)
+	b = append(b, 1, 0)
+	b = binary.BigEndian.AppendUint16(b, uint16(len(ext)))
+	b = append(b, ext...)
+
+	binary.BigEndian.PutUint16(b[3:5], uint16(len(b)-5))
+	n := len(b) - 9
+	b[6], b[7], b[8] = byte(n>>16), byte(n>>8), byte(n)
+	return b
+}
+
+func appendExt(b []byte, typ uint16, data func([]byte) []byte) []byte {
+	b = binary.BigEndian.AppendUint16(b, typ)
+	b = append(b, 0, 0)
+	start := len(b)
+	if data != nil {
+		b = data(b)
+	}
+	binary.BigEndian.PutUint16(b[start-2:start], uint16(len(b)-start))
+	return b
+}
+
+// randomizeHello fills random, session ID and key shares of a ClientHello
+// held in a single TLS record with fresh random bytes. Other layouts are
+// left alone.
+func randomizeHello(b []byte) {
+	h, err := tlshello.ParseRecords(b)
+	if err != nil || len(h.Records) != 1 || h.Truncated {
+		return
+	}
+	p := h.Off + 4 + 2
+	if p+33 > len(b) {
+		return
+	}
+	_, _ = rand.Read(b[p : p+32])
+	p += 32
+	if sid := int(b[p]); p+1+sid <= len(b) {
+		_, _ = rand.Read(b[p+1 : p+1+sid])
+	}
+	e, ok := h.Ext(extKeyShare)
+	if !ok || e.Len < 2 {
+		return
+	}
+	d := b[e.Off+4 : e.Off+4+e.Len]
+	for i := 2; i+4 <= len(d); {
+		n := int(binary.BigEndian.Uint16(d[i+2 : i+4]))
+		if i+4+n > len(d) {
+			return
+		}
+		_, _ = rand.Read(d[i+4 : i+4+n])
+		i += 4 + n
+	}
+}
@@ -0,0 +1,168 @@
+package mangle
+
+import (
+	"bytes"
+	"encoding/binary"
+	"slices"
+	"testing"
+
+	"github.com/daniellavrushin/b4/config"
+	"github.com/daniellavrushin/b4/sni"
+	"github.com/daniellavrushin/b4/tlshello"
+)
+
+// checkLengths reports whether the record and handshake length fields of a
+// single-record hello match its size.
+func checkLengths(t *testing.T, b []byte) {
+	t.Helper()
+	if rec := int(binary.BigEndian.Uint16(b[3:5])); rec != len(b)-5 {
+		t.Errorf("record length %d, want %d", rec, len(b)-5)
+	}
+	if hs := int(b[6])<<16 | int(b[7])<<8 | int(b[8]); hs != len(b)-9 {
+		t.Errorf("handshake length %d, want %d", hs, len(b)-9)
+	}
+}
+
+func TestBuildClientHello(t *testing.T) {
+	const host = "www.google.com"
+	natural := len(buildClientHello(host, 0))
+
+	tests := []struct {
+		name string
+		sni  string
+		size int
+		want int // total length, natural when not padded
+	}{
+		{name: "unpadded", sni: host},
+		{name: "smaller than the hello", sni: host, size: natural - 10},
+		{name: "equal to the hello", sni: host, size: natural},
+		{name: "too little room for the extension", sni: host, size: natural + 3},
+		{name: "empty padding", sni: host, size: natural + 4, want: natural + 4},
+		{name: "browser size", sni: host, size: 517, want: 517},
+		{name: "full segment", sni: host, size: 1400, want: 1400},
+		{name: "largest record", sni: host, size: 5 + 0x4000, want: 5 + 0x4000},
+		{name: "past the largest record", sni: host, size: 6 + 0x4000},
+		{name: "long name", sni: "a-rather-long-decoy-name.cdn.example.org", size: 600, want: 600},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := buildClientHello(tt.sni, tt.size)
+			base := len(buildClientHello(tt.sni, 0))
+			want := tt.want
+			if want == 0 {
+				want = base
+			}
+			if len(b) != want {
+				t.Fatalf("length %d, want %d", len(b), want)
+			}
+			checkLengths(t, b)
+			if got, ok := sni.ParseTLSClientHelloSNI(b); !ok || got != tt.sni {
+				t.Errorf("ParseTLSClientHelloSNI = %q, %t", got, ok)
+			}
+			h, err := tlshello.ParseRecords(b)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !slices.Equal(h.ALPN, []string{"h2", "http/1.1"}) {
+				t.Errorf("ALPN %q", h.ALPN)
+			}
+			e, padded := h.Ext(extPadding)
+			if padded != (tt.want != 0) {
+				t.Fatalf("padding extension present %t, want %t", padded, tt.want != 0)
+			}
+			if padded {
+				if e.Off+4+e.Len != len(b) {
+					t.Errorf("padding ends at %d of %d", e.Off+4+e.Len, len(b))
+				}
+				if e.Len != tt.size-base-4 {
+					t.Errorf("padding length %d, want %d", e.Len, tt.size-base-4)
+				}
+			}
+		})
+	}
+}
+
+func TestRandomizeHello(t *testing.T) {
+	const host = "www.google.com"
+	orig := buildClientHello(host, 517)
+	h, err := tlshello.ParseRecords(orig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ks, ok := h.Ext(extKeyShare)
+	if !ok {
+		t.Fatal("no key_share")
+	}
+	random := [2]int{h.Off + 6, h.Off + 38}
+	session := [2]int{h.Off + 39, h.Off + 71}
+	share := [2]int{ks.Off + 4 + 6, ks.Off + 4 + ks.Len}
+	inside := func(i int) bool {
+		for _, r := range [][2]int{random, session, share} {
+			if i >= r[0] && i < r[1] {
+				return true
+			}
+		}
+		return false
+	}
+
+	b := slices.Clone(orig)
+	randomizeHello(b)
+	if len(b) != len(orig) {
+		t.Fatalf("length %d, want %d", len(b), len(orig))
+	}
+	checkLengths(t, b)
+	for i := range b {
+		if b[i] != orig[i] && !inside(i) {
+			t.Fatalf("byte %d changed outside random, session ID and key share", i)
+		}
+	}
+	for _, r := range [][2]int{random, session, share} {
+		if bytes.Equal(b[r[0]:r[1]], orig[r[0]:r[1]]) {
+			t.Errorf("bytes %d-%d left zero", r[0], r[1])
+		}
+	}
+	nh, err := tlshello.ParseRecords(b)
+	if err != nil || nh.SNI != host || !slices.Equal(nh.Extensions, h.Extensions) {
+		t.Errorf("randomized hello reparsed as %q, %v", nh.SNI, err)
+	}
+
+	again := slices.Clone(orig)
+	randomizeHello(again)
+	if bytes.Equal(again[random[0]:random[1]], b[random[0]:random[1]]) {
+		t.Error("two fakes share a random")
+	}
+
+	split := wrapRecords(orig[5:], 40)
+	kept := slices.Clone(split)
+	randomizeHello(kept)
+	if !bytes.Equal(kept, split) {
+		t.Error("hello in two records was modified")
+	}
+}
+
+func TestFakePayload(t *testing.T) {
+	st := config.Strategy{FakeType: config.FakeTypeDefault, FakeSNI: "www.google.com", FakePad: true}
+	b := fakePayload(&st, 700)
+	if len(b) != 700 {
+		t.Errorf("padded fake is %d bytes, want 700", len(b))
+	}
+	checkLengths(t, b)
+
+	st.FakeType = config.FakeTypeRandom
+	b = fakePayload(&st, 700)
+	if len(b) != fakeRandomLen || b[0] != tlshello.ContentTypeHandshake || b[5] != tlshello.TypeClientHello {
+		t.Errorf("random fake: %d bytes, header % x", len(b), b[:6])
+	}
+	if rec := int(binary.BigEndian.Uint16(b[3:5])); rec != len(b)-5 {
+		t.Errorf("random fake record length %d, want %d", rec, len(b)-5)
+	}
+
+	st.FakeHello = buildClientHello("captured.example", 0)
+	b = fakePayload(&st, 700)
+	if got, ok := sni.ParseTLSClientHelloSNI(b); !ok || got != "captured.example" {
+		t.Errorf("captured fake parsed as %q, %t", got, ok)
+	}
+	if &b[0] == &st.FakeHello[0] {
+		t.Error("captured fake randomized in place")
+	}
+}
@@ -0,0 +1,71 @@
+package mangle
+
+import (
+	"encoding/binary"
+
+	"github.com/daniellavrushin/b4/config"
+)
+
+// badAckDelta moves the acknowledgment number of a fake well behind anything
+// the server sent, so the server discards the segment while a DPI box that
+// does not track acknowledgments still parses it.
+const badAckDelta = 66000
+
+// withMD5Sig returns a copy of the TCP header with an RFC 2385 signature
+// option in front of the existing options. Servers without a configured key
+// drop such segments. The header is returned unchanged when the option does
+// not fit.
+func withMD5Sig(tcph []byte) []byte {
+	const opt = 20 // NOP, NOP, kind 19, length 18, 16 byte digest
+	if len(tcph) < 20 || len(tcph)+opt > 60 {
+		return tcph
+	}
+	out := make([]byte, len(tcph)+opt)
+	copy(out, tcph[:20])
+	out[20], out[21], out[22], out[23] = 1, 1, 19, 18
+	copy(out[20+opt:], tcph[20:])
+	out[12] = byte(len(out)/4)<<4 | out[12]&0x0f
+	return out
+}
+
+// tcpOption returns the offset of the first option of kind in tcph, or -1.
+func tcpOption(tcph []byte, kind byte) int {
+	for i := 20; i < len(tcph); {
+		switch tcph[i] {
+		case 0:
+			return -1
+		case 1:
+			i++
+			continue
+		}
+		if i+1 >= len(tcph) || tcph[i+1] < 2 {
+			return -1
+		}
+		if tcph[i] == kind {
+			return i
+		}
+		i += int(tcph[i+1])
+	}
+	return -1
+}
+
+// foolTCP applies the header fooling of st to the TCP header of a fake
+// before its checksums are computed.
+func foolTCP(st *config.Strategy, tcph []byte) {
+	if st.FakeBadAck {
+		ack := binary.BigEndian.Uint32(tcph[8:12])
+		binary.BigEndian.PutUint32(tcph[8:12], ack-badAckDelta)
+	}
+	if st.FakeTSDecrease > 0 {
+		if i := tcpOption(tcph, 8); i >= 0 && i+10 <= len(tcph) {
+			ts := binary.BigEndian.Uint32(tcph[i+2 : i+6])
+			binary.BigEndian.PutUint32(tcph[i+2:i+6], ts-uint32(st.FakeTSDecrease))
+		}
+	}
+}
+
+// breakTCPChecksum corrupts the checksum of a finished segment.
+func breakTCPChecksum(seg []byte, ipLen int) {
+	c := seg[ipLen+16 : ipLen+18]
+	binary.BigEndian.PutUint16(c, binary.BigEndian.Uint16(c)+1)
+}
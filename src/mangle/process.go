@@ -1,10 +1,9 @@
 package mangle
 
 import (
-	"strings"
-	"time"
+	"net/netip"
+	"sync/atomic"
 
-	"github.com/daniellavrushin/b4/config"
 	"github.com/google/gopacket"
 	"github.com/google/gopacket/layers"
 )
@@ -15,91 +14,93 @@ const (
 	VerdictAccept Verdict = iota
 	VerdictDrop
 	VerdictContinue
+	// VerdictModify accepts the packet as Process rewrote it in place.
+	VerdictModify
+	// VerdictDropTrack drops the packet and marks its connection, so the
+	// firewall queues all of it for shiftSegment.
+	VerdictDropTrack
 )
 
-var (
-	defaultFragStrategyTCP   = true
-	defaultFragSNIReverse    = true
-	defaultFragMiddleSNI     = true
-	defaultFragSNIPos        = 1
-	defaultFakeSeqOffset     = 10000
-	defaultFakeSNISeqLen     = 1
-	defaultSeg2Delay         = 0 * time.Millisecond
-	defaultUDPModeFake       = true
-	defaultUDPFakeSeqLen     = 6
-	defaultUDPFakeLen        = 64
-	defaultUDPFakingChecksum = false
-)
+// Processor holds the decoder state for a single queue worker. It must not be
+// shared between goroutines; create one per worker with NewProcessor. Only
+// SetRuleset may be called concurrently with Process.
+type Processor struct {
+	rs      atomic.Pointer[Ruleset]
+	ipv4    layers.IPv4
+	ipv6    layers.IPv6
+	ipv6ext layers.IPv6ExtensionSkipper
+	tcp     layers.TCP
+	udp     layers.UDP
+	payload gopacket.Payload
+
+	dec4    *gopacket.DecodingLayerParser
+	dec6    *gopacket.DecodingLayerParser
+	decoded []gopacket.LayerType
+}
 
-func Process(cfg *config.Config, pkt []byte) Verdict {
-	if cfg == nil || len(pkt) < 1 {
+func NewProcessor(rs *Ruleset) *Processor {
+	p := &Processor{decoded: make([]gopacket.LayerType, 0, 8)}
+	p.rs.Store(rs)
+	p.dec4 = gopacket.NewDecodingLayerParser(layers.LayerTypeIPv4, &p.ipv4, &p.tcp, &p.udp, &p.payload)
+	// The skipper walks the extension headers IPv6 itself leaves; locateTCP
+	// walks them again to find the TCP header in the raw packet.
+	p.dec6 = gopacket.NewDecodingLayerParser(layers.LayerTypeIPv6, &p.ipv6, &p.ipv6ext, &p.tcp, &p.udp, &p.payload)
+	// Payloads on well-known ports name decoders (TLS, DNS) that are not
+	// registered; decoding stops there with the transport layer in hand.
+	p.dec4.IgnoreUnsupported = true
+	p.dec6.IgnoreUnsupported = true
+	return p
+}
+
+func (p *Processor) SetRuleset(rs *Ruleset) {
+	p.rs.Store(rs)
+}
+
+func (p *Processor) Process(pkt []byte) Verdict {
+	rs := p.rs.Load()
+	if rs == nil || len(pkt) < 1 {
 		return VerdictAccept
 	}
-	ensureRawOnce(cfg.Mark)
-	dec := gopacket.NewDecodingLayerParser(layers.LayerTypeIPv4, &ipv4, &ipv6, &tcp, &udp, &payload)
-	decoded := decodedLayers[:0]
-	if err := dec.DecodeLayers(pkt, &decoded); err != nil {
+	ensureRaw(rs.cfg.Mark)
+	var dec *gopacket.DecodingLayerParser
+	v6 := false
+	switch pkt[0] >> 4 {
+	case 4:
+		dec = p.dec4
+	case 6:
+		dec = p.dec6
+		v6 = true
+	default:
 		return VerdictAccept
 	}
-	matcher := func(host string) bool { return anySuffixMatch(strings.ToLower(host), cfg.SNIDomains) }
-	for _, l := range decoded {
+	if err := dec.DecodeLayers(pkt, &p.decoded); err != nil {
+		return VerdictAccept
+	}
+	var dst netip.Addr
+	if v6 {
+		dst, _ = netip.AddrFromSlice(p.ipv6.DstIP)
+	} else {
+		dst, _ = netip.AddrFromSlice(p.ipv4.DstIP)
+	}
+	for _, l := range p.decoded {
 		switch l {
 		case layers.LayerTypeTCP:
-			if tcp.DstPort != 443 && tcp.SrcPort != 443 {
+			if !rs.cfg.TCPPorts.Contains(uint16(p.tcp.DstPort)) && !rs.cfg.TCPPorts.Contains(uint16(p.tcp.SrcPort)) {
 				continue
 			}
-			rawL3 := pkt
-			if ipv4.LayerContents() != nil {
-				rawL3 = pkt
-			} else if ipv6.LayerContents() != nil {
-				rawL3 = pkt
+			if v, ok := shiftSegment(pkt, !rs.cfg.TCPPorts.Contains(uint16(p.tcp.DstPort))); ok {
+				return v
 			}
-			return processTCP(matcher, rawL3)
+			return processTCP(rs.resolveFor(dst), pkt)
 		case layers.LayerTypeUDP:
-			if udp.DstPort != 443 && udp.SrcPort != 443 {
+			if !rs.cfg.UDPPorts.Contains(uint16(p.udp.DstPort)) && !rs.cfg.UDPPorts.Contains(uint16(p.udp.SrcPort)) {
 				continue
 			}
-			if len(udp.Payload) == 0 {
+			if len(p.udp.Payload) == 0 {
 				continue
 			}
-			if ipv4.LayerContents() != nil {
-				return processUDP(matcher, pkt, false)
-			} else if ipv6.LayerContents() != nil {
-				return processUDP(matcher, pkt, true)
-			}
+			return processUDP(rs.resolveFor(dst), pkt, v6)
 		}
 	}
 	return VerdictAccept
 }
-
-func anySuffixMatch(host string, suffixes []string) bool {
-	if host == "" || len(suffixes) == 0 {
-		return false
-	}
-	for _, s := range suffixes {
-		s = strings.TrimSpace(strings.ToLower(s))
-		if s == "" {
-			continue
-		}
-		if strings.HasPrefix(s, "*.") {
-			s = strings.TrimPrefix(s, "*.")
-		}
-		if strings.HasPrefix(s, ".") {
-			s = strings.TrimPrefix(s, ".")
-		}
-		if host == s || strings.HasSuffix(host, "."+s) {
-			return true
-		}
-	}
-	return false
-}
-
-var (
-	ipv4    layers.IPv4
-	ipv6    layers.IPv6
-	tcp     layers.TCP
-	udp     layers.UDP
-	payload gopacket.Payload
-
-	decodedLayers [8]gopacket.LayerType
-)
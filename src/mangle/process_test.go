@@ -0,0 +1,62 @@
+package mangle
+
+import (
+	"encoding/binary"
+	"testing"
+
+	"github.com/daniellavrushin/b4/config"
+	"github.com/daniellavrushin/b4/ports"
+)
+
+// tcp6Packet builds an IPv6 segment to port 443 behind the given extension
+// headers, each an 8-byte header of the listed type.
+func tcp6Packet(exts []byte, payload []byte) []byte {
+	pkt := make([]byte, 40)
+	pkt[0], pkt[7] = 0x60, 64
+	pkt[8], pkt[23] = 0x20, 1
+	pkt[24], pkt[39] = 0x20, 2
+	next := &pkt[6]
+	for _, e := range exts {
+		*next = e
+		pkt = append(pkt, 0, 0, 1, 4, 0, 0, 0, 0) // PadN filling the header
+		next = &pkt[len(pkt)-8]
+	}
+	*next = 6
+	tcph := make([]byte, 20)
+	binary.BigEndian.PutUint16(tcph[0:2], 40000)
+	binary.BigEndian.PutUint16(tcph[2:4], 443)
+	tcph[12], tcph[13] = 5<<4, tcpFlagACK
+	pkt = append(append(pkt, tcph...), payload...)
+	finishTCPSeg(pkt, len(pkt)-len(payload)-20, 20)
+	return pkt
+}
+
+func TestProcessIPv6Extensions(t *testing.T) {
+	// Injection is never reached, but Process opens the sockets first.
+	rawSocks.mu.Lock()
+	rawSocks.opened = true
+	rawSocks.mu.Unlock()
+
+	cfg := &config.Config{TCPPorts: ports.Set{{Lo: 443, Hi: 443}}}
+	p := NewProcessor(NewRuleset(cfg))
+	hello := wrapRecords(helloMsg("unmatched.example.com"))
+	tests := []struct {
+		name string
+		exts []byte
+	}{
+		{"none", nil},
+		{"hop-by-hop", []byte{0}},
+		{"destination options", []byte{60}},
+		{"hop-by-hop and destination options", []byte{0, 60}},
+	}
+	for _, tt := range tests {
+		pkt := tcp6Packet(tt.exts, hello)
+		// An unmatched hello is handed on; an undecoded packet is accepted.
+		if v := p.Process(pkt); v != VerdictContinue {
+			t.Errorf("%s: verdict %d, want the ClientHello parsed", tt.name, v)
+		}
+	}
+	if v := p.Process(tcpPacket(1000, tcpFlagACK, hello)); v != VerdictContinue {
+		t.Errorf("IPv4: verdict %d, want the ClientHello parsed", v)
+	}
+}
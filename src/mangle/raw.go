@@ -9,31 +9,45 @@ import (
 	"golang.org/x/sys/unix"
 )
 
-var (
-	onceRaw sync.Once
-	fd4     = -1
-	fd6     = -1
+// rawSocks holds the injection sockets shared by all queue workers. Sendto on a
+// single raw socket is safe from multiple goroutines; the lock only guards
+// the descriptors against a concurrent open or close.
+var rawSocks = struct {
+	mu      sync.RWMutex
+	fd4     int
+	fd6     int
 	markVal uint32
-)
+	opened  bool
+}{fd4: -1, fd6: -1}
 
-func ensureRawOnce(mark uint) {
-	onceRaw.Do(func() {
-		markVal = uint32(mark)
-		openRaw()
-	})
+func ensureRaw(mark uint) {
+	rawSocks.mu.RLock()
+	opened := rawSocks.opened
+	rawSocks.mu.RUnlock()
+	if opened {
+		return
+	}
+	rawSocks.mu.Lock()
+	defer rawSocks.mu.Unlock()
+	if rawSocks.opened {
+		return
+	}
+	rawSocks.markVal = uint32(mark)
+	openRawLocked()
+	rawSocks.opened = true
 }
 
-func openRaw() {
+func openRawLocked() {
 	fd, err := unix.Socket(unix.AF_INET, unix.SOCK_RAW, unix.IPPROTO_RAW)
 	if err == nil {
 		_ = unix.SetsockoptInt(fd, unix.IPPROTO_IP, unix.IP_HDRINCL, 1)
-		_ = unix.SetsockoptInt(fd, unix.SOL_SOCKET, unix.SO_MARK, int(markVal))
-		fd4 = fd
+		_ = unix.SetsockoptInt(fd, unix.SOL_SOCKET, unix.SO_MARK, int(rawSocks.markVal))
+		rawSocks.fd4 = fd
 	}
 	fd, err = unix.Socket(unix.AF_INET6, unix.SOCK_RAW, unix.IPPROTO_RAW)
 	if err == nil {
-		_ = unix.SetsockoptInt(fd, unix.SOL_SOCKET, unix.SO_MARK, int(markVal))
-		fd6 = fd
+		_ = unix.SetsockoptInt(fd, unix.SOL_SOCKET, unix.SO_MARK, int(rawSocks.markVal))
+		rawSocks.fd6 = fd
 	}
 }
 
@@ -41,22 +55,24 @@ func sendRaw(pkt []byte) error {
 	if len(pkt) < 1 {
 		return nil
 	}
+	rawSocks.mu.RLock()
+	defer rawSocks.mu.RUnlock()
 	v := pkt[0] >> 4
 	if v == 4 {
-		if fd4 < 0 {
+		if rawSocks.fd4 < 0 {
 			return errors.New("raw4")
 		}
 		sa := &unix.SockaddrInet4{}
 		copy(sa.Addr[:], pkt[16:20])
-		return unix.Sendto(fd4, pkt, 0, sa)
+		return unix.Sendto(rawSocks.fd4, pkt, 0, sa)
 	}
 	if v == 6 {
-		if fd6 < 0 {
+		if rawSocks.fd6 < 0 {
 			return errors.New("raw6")
 		}
 		sa := &unix.SockaddrInet6{ZoneId: 0}
 		copy(sa.Addr[:], pkt[24:40])
-		return unix.Sendto(fd6, pkt, 0, sa)
+		return unix.Sendto(rawSocks.fd6, pkt, 0, sa)
 	}
 	return nil
 }
@@ -82,6 +98,19 @@ func tcpChecksumIPv4(ip, tcp []byte, data []byte) uint16 {
 	return ^uint16(sum)
 }
 
+func tcpChecksumIPv6(ip6, tcp []byte, data []byte) uint16 {
+	sum := checksum(ip6[8:40], 0)
+	sum += uint32(len(tcp) + len(data))
+	sum += uint32(6)
+	tcpSum := checksum(tcp[:16], 0) + checksum(tcp[18:], 0)
+	sum += tcpSum
+	sum = checksum(data, sum)
+	for sum > 0xffff {
+		sum = (sum >> 16) + (sum & 0xffff)
+	}
+	return ^uint16(sum)
+}
+
 func udpChecksumIPv4(ip, udp []byte, data []byte) uint16 {
 	sum := uint32(0)
 	for i := 12; i < 20; i += 2 {
@@ -159,15 +188,18 @@ func putIPChecksum(ip []byte) {
 }
 
 func CloseRaw() error {
+	rawSocks.mu.Lock()
+	defer rawSocks.mu.Unlock()
 	var err error
-	if fd4 >= 0 {
-		err = unix.Close(fd4)
-		fd4 = -1
+	if rawSocks.fd4 >= 0 {
+		err = unix.Close(rawSocks.fd4)
+		rawSocks.fd4 = -1
 	}
-	if fd6 >= 0 {
-		_ = unix.Close(fd6)
-		fd6 = -1
+	if rawSocks.fd6 >= 0 {
+		_ = unix.Close(rawSocks.fd6)
+		rawSocks.fd6 = -1
 	}
+	rawSocks.opened = false
 	return err
 }
 
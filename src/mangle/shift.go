@@ -0,0 +1,185 @@
+package mangle
+
+import (
+	"encoding/binary"
+	"net/netip"
+	"sync"
+	"time"
+)
+
+// shiftTable follows the connections whose ClientHello went out longer than
+// the kernel wrote it, because splitRecords added record headers. Later
+// client segments are moved up by the added bytes and the server's
+// acknowledgments moved back, so neither TCP stack notices. The firewall
+// queues these connections by their conntrack mark for as long as they live.
+var shiftTable = struct {
+	mu sync.Mutex
+	m  map[flowKey]*shiftEntry
+}{m: make(map[flowKey]*shiftEntry)}
+
+type flowKey struct {
+	client, server netip.AddrPort
+}
+
+type shiftEntry struct {
+	hello uint32  // sequence number of the rewritten segment
+	end   uint32  // sequence number just past it, as the kernel counts
+	add   uint32  // bytes added to the stream
+	acked bool    // the server acknowledged all of the rewritten segment
+	fin   [2]bool // FIN seen from the client, from the server
+	seen  time.Time
+}
+
+const (
+	shiftTableMax = 16384
+	shiftIdle     = 15 * time.Minute
+
+	tcpFlagFIN = 0x01
+	tcpFlagSYN = 0x02
+	tcpFlagRST = 0x04
+	tcpFlagACK = 0x10
+
+	tcpOptSACK = 5
+)
+
+func srcAddr(ip []byte) netip.Addr {
+	if len(ip) >= 40 && ip[0]>>4 == 6 {
+		return netip.AddrFrom16([16]byte(ip[8:24]))
+	}
+	if len(ip) >= 20 {
+		return netip.AddrFrom4([4]byte(ip[12:16]))
+	}
+	return netip.Addr{}
+}
+
+// segmentFlow returns the key of a segment sent by the client, or of one
+// sent by the server when fromServer is set.
+func segmentFlow(raw []byte, l4Off int, fromServer bool) flowKey {
+	ip := raw[:l4Off]
+	src := netip.AddrPortFrom(srcAddr(ip), binary.BigEndian.Uint16(raw[l4Off:l4Off+2]))
+	dst := netip.AddrPortFrom(dstAddr(ip), binary.BigEndian.Uint16(raw[l4Off+2:l4Off+4]))
+	if fromServer {
+		return flowKey{client: dst, server: src}
+	}
+	return flowKey{client: src, server: dst}
+}
+
+// trackShift starts shifting the connection of the client segment raw,
+// whose payload is about to go out grown by add bytes. It reports false when
+// the table is full, in which case the payload must go out as it is.
+func trackShift(raw []byte, l4Off, tcpOff, add int) bool {
+	k := segmentFlow(raw, l4Off, false)
+	seq := binary.BigEndian.Uint32(raw[l4Off+4 : l4Off+8])
+	now := time.Now()
+	shiftTable.mu.Lock()
+	defer shiftTable.mu.Unlock()
+	if _, ok := shiftTable.m[k]; !ok && len(shiftTable.m) >= shiftTableMax {
+		for fk, e := range shiftTable.m {
+			if now.Sub(e.seen) > shiftIdle {
+				delete(shiftTable.m, fk)
+			}
+		}
+		if len(shiftTable.m) >= shiftTableMax {
+			return false
+		}
+	}
+	shiftTable.m[k] = &shiftEntry{
+		hello: seq,
+		end:   seq + uint32(len(raw)-tcpOff),
+		add:   uint32(add),
+		seen:  now,
+	}
+	return true
+}
+
+func untrackShift(raw []byte, l4Off int) {
+	shiftTable.mu.Lock()
+	delete(shiftTable.m, segmentFlow(raw, l4Off, false))
+	shiftTable.mu.Unlock()
+}
+
+// unshift maps an acknowledgment of the grown stream back to the stream
+// the kernel wrote.
+func (e *shiftEntry) unshift(ack uint32) uint32 {
+	switch {
+	case e.acked || int32(ack-(e.end+e.add)) >= 0:
+		return ack - e.add
+	case int32(ack-e.hello) > 0:
+		// Part of the rewritten segment: report none of it, so the kernel
+		// retransmits it whole and it is rewritten again.
+		return e.hello
+	}
+	return ack
+}
+
+// shiftSegment applies the shift of a tracked connection to raw in place.
+// It reports false when raw belongs to no such connection, and for a
+// retransmission of the rewritten segment, which processTCP rewrites again.
+// The connection is forgotten on a RST, on the ACK that follows FINs from
+// both sides, and on a client SYN, which starts a new connection on the
+// same addresses.
+func shiftSegment(raw []byte, fromServer bool) (Verdict, bool) {
+	_, _, l4Off, tcpOff, ok := locateTCP(raw)
+	if !ok || tcpOff > len(raw) {
+		return VerdictAccept, false
+	}
+	k := segmentFlow(raw, l4Off, fromServer)
+	tcph := raw[l4Off:tcpOff]
+
+	shiftTable.mu.Lock()
+	e, ok := shiftTable.m[k]
+	if !ok {
+		shiftTable.mu.Unlock()
+		return VerdictAccept, false
+	}
+	e.seen = time.Now()
+	flags := tcph[13]
+	if !fromServer && flags&tcpFlagSYN != 0 {
+		delete(shiftTable.m, k)
+		shiftTable.mu.Unlock()
+		return VerdictAccept, false
+	}
+	side := 0
+	if fromServer {
+		side = 1
+	}
+	if flags&tcpFlagRST != 0 || e.fin[0] && e.fin[1] && flags&tcpFlagFIN == 0 {
+		delete(shiftTable.m, k)
+	}
+	if flags&tcpFlagFIN != 0 {
+		e.fin[side] = true
+	}
+	if !fromServer {
+		seq := binary.BigEndian.Uint32(tcph[4:8])
+		switch {
+		case !e.acked && seq == e.hello:
+			shiftTable.mu.Unlock()
+			return VerdictAccept, false
+		case !e.acked && int32(seq-e.end) < 0:
+			// A piece of the rewritten segment; the kernel retransmits
+			// from its start once the acknowledgment is held back.
+			shiftTable.mu.Unlock()
+			return VerdictDrop, true
+		}
+		binary.BigEndian.PutUint32(tcph[4:8], seq+e.add)
+	} else {
+		if tcph[13]&tcpFlagACK == 0 {
+			shiftTable.mu.Unlock()
+			return VerdictAccept, true
+		}
+		ack := binary.BigEndian.Uint32(tcph[8:12])
+		if int32(ack-(e.end+e.add)) >= 0 {
+			e.acked = true
+		}
+		binary.BigEndian.PutUint32(tcph[8:12], e.unshift(ack))
+		if i := tcpOption(tcph, tcpOptSACK); i >= 0 {
+			for j := i + 2; j+4 <= i+int(tcph[i+1]) && j+4 <= len(tcph); j += 4 {
+				edge := binary.BigEndian.Uint32(tcph[j : j+4])
+				binary.BigEndian.PutUint32(tcph[j:j+4], e.unshift(edge))
+			}
+		}
+	}
+	shiftTable.mu.Unlock()
+	finishTCPSeg(raw, l4Off, tcpOff-l4Off)
+	return VerdictModify, true
+}
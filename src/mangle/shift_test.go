@@ -0,0 +1,72 @@
+package mangle
+
+import (
+	"encoding/binary"
+	"testing"
+)
+
+// serverPacket builds a segment from the server of tcpPacket to its client.
+func serverPacket(ack uint32, flags byte) []byte {
+	pkt := tcpPacket(5000, flags, nil)
+	src := [4]byte(pkt[12:16])
+	copy(pkt[12:16], pkt[16:20])
+	copy(pkt[16:20], src[:])
+	binary.BigEndian.PutUint16(pkt[20:22], 443)
+	binary.BigEndian.PutUint16(pkt[22:24], 40000)
+	binary.BigEndian.PutUint32(pkt[28:32], ack)
+	finishTCPSeg(pkt, 20, 20)
+	return pkt
+}
+
+func TestShiftConnectionEnd(t *testing.T) {
+	hello := tcpPacket(1000, tcpFlagACK, make([]byte, 100))
+	key := segmentFlow(hello, 20, false)
+
+	for _, end := range []string{"FIN", "SYN"} {
+		shiftTable.mu.Lock()
+		delete(shiftTable.m, key)
+		shiftTable.mu.Unlock()
+		if !trackShift(hello, 20, 40, 10) {
+			t.Fatal("table full")
+		}
+		steps := []struct {
+			name    string
+			pkt     []byte
+			server  bool
+			seq     uint32 // wanted client sequence or server acknowledgment
+			tracked bool
+		}{
+			{"server acks the hello", serverPacket(1110, tcpFlagACK), true, 1100, true},
+			{"client data", tcpPacket(1100, tcpFlagACK, []byte("x")), false, 1110, true},
+			{"client FIN", tcpPacket(1101, tcpFlagACK|tcpFlagFIN, nil), false, 1111, true},
+			{"server FIN", serverPacket(1112, tcpFlagACK|tcpFlagFIN), true, 1102, true},
+			{"last ACK", tcpPacket(1102, tcpFlagACK, nil), false, 1112, false},
+		}
+		for _, s := range steps {
+			if end == "SYN" && s.name == "client FIN" {
+				syn := tcpPacket(9000, tcpFlagSYN, nil)
+				if _, ok := shiftSegment(syn, false); ok || binary.BigEndian.Uint32(syn[24:28]) != 9000 {
+					t.Errorf("SYN of a new connection was shifted")
+				}
+				break
+			}
+			v, ok := shiftSegment(s.pkt, s.server)
+			if !ok || v != VerdictModify {
+				t.Fatalf("%s: verdict %d, %t", s.name, v, ok)
+			}
+			field := s.pkt[24:28]
+			if s.server {
+				field = s.pkt[28:32]
+			}
+			if got := binary.BigEndian.Uint32(field); got != s.seq {
+				t.Errorf("%s: %d, want %d", s.name, got, s.seq)
+			}
+			if _, ok := shiftTable.m[key]; ok != s.tracked {
+				t.Errorf("%s: tracked %t, want %t", s.name, ok, s.tracked)
+			}
+		}
+		if _, ok := shiftTable.m[key]; ok {
+			t.Errorf("after %s: connection still shifted", end)
+		}
+	}
+}
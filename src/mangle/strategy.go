@@ -0,0 +1,76 @@
+package mangle
+
+import (
+	"net/netip"
+
+	"github.com/daniellavrushin/b4/cidr"
+	"github.com/daniellavrushin/b4/config"
+	"github.com/daniellavrushin/b4/sni"
+)
+
+// Ruleset is an immutable snapshot of the matching state shared by all
+// processors. A reload builds a new Ruleset and swaps it in with SetRuleset.
+type Ruleset struct {
+	cfg *config.Config
+	res *resolver
+	ips *cidr.Set
+}
+
+func NewRuleset(cfg *config.Config) *Ruleset {
+	rs := &Ruleset{cfg: cfg, res: newResolver(cfg)}
+	if len(cfg.TargetIPs) > 0 {
+		rs.ips = cidr.New(cfg.TargetIPs)
+	}
+	return rs
+}
+
+// resolveFor returns the strategy lookup for a packet to dst. SNI rules
+// come first; a destination in TargetIPs falls back to the global strategy,
+// which also covers hellos without a usable SNI (ECH, IP literals).
+func (rs *Ruleset) resolveFor(dst netip.Addr) func(string) (*config.Strategy, bool) {
+	if !rs.ips.Contains(dst) {
+		return rs.res.resolve
+	}
+	return func(host string) (*config.Strategy, bool) {
+		if st, ok := rs.res.resolve(host); ok {
+			return st, true
+		}
+		return rs.res.global, true
+	}
+}
+
+// resolver picks the Strategy for a matched SNI. Domains from the global list
+// use cfg.Strategy. Profiles are added before the global list and the
+// sni.Matcher keeps the first tag of a repeated rule, so a profile overrides
+// an identical global rule and the first profile wins over later ones; the
+// Matcher precedence (full, longest suffix, keyword, regexp) decides between
+// different rules. Regexps were validated by config.Validate.
+type resolver struct {
+	m          *sni.Matcher
+	global     *config.Strategy
+	strategies []*config.Strategy
+}
+
+const globalTag = -1
+
+func newResolver(cfg *config.Config) *resolver {
+	r := &resolver{m: sni.NewMatcher(), global: &cfg.Strategy}
+	for i := range cfg.Profiles {
+		p := &cfg.Profiles[i]
+		_ = r.m.Add(p.SNIDomains, len(r.strategies))
+		r.strategies = append(r.strategies, &p.Strategy)
+	}
+	_ = r.m.Add(cfg.SNIDomains, globalTag)
+	return r
+}
+
+func (r *resolver) resolve(host string) (*config.Strategy, bool) {
+	tag, ok := r.m.Lookup(host)
+	if !ok {
+		return nil, false
+	}
+	if tag == globalTag {
+		return r.global, true
+	}
+	return r.strategies[tag], true
+}
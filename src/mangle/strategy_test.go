@@ -0,0 +1,34 @@
+package mangle
+
+import (
+	"testing"
+
+	"github.com/daniellavrushin/b4/config"
+)
+
+func TestResolverPrecedence(t *testing.T) {
+	for _, rule := range []string{"full:www.youtube.com", "youtube.com", "keyword:youtube", `regexp:^www\.youtube\.`} {
+		t.Run(rule, func(t *testing.T) {
+			cfg := &config.Config{
+				SNIDomains: []string{rule},
+				Profiles: []config.Profile{
+					{Name: "first", SNIDomains: []string{rule}},
+					{Name: "second", SNIDomains: []string{rule}},
+				},
+			}
+			r := newResolver(cfg)
+			st, ok := r.resolve("www.youtube.com")
+			if !ok || st != &cfg.Profiles[0].Strategy {
+				t.Errorf("resolved to %p, want the first profile %p", st, &cfg.Profiles[0].Strategy)
+			}
+		})
+	}
+
+	cfg := &config.Config{
+		SNIDomains: []string{"full:www.youtube.com"},
+		Profiles:   []config.Profile{{Name: "video", SNIDomains: []string{"keyword:youtube"}}},
+	}
+	if st, _ := newResolver(cfg).resolve("www.youtube.com"); st != &cfg.Strategy {
+		t.Errorf("a global full rule lost to a profile keyword")
+	}
+}
@@ -2,13 +2,16 @@ package mangle
 
 import (
 	"encoding/binary"
+	"slices"
 	"time"
 
+	"github.com/daniellavrushin/b4/config"
 	"github.com/daniellavrushin/b4/log"
+	"github.com/daniellavrushin/b4/tlshello"
 )
 
-func processTCP(match func(string) bool, raw []byte) Verdict {
-	_, ip6, ihl, tcpOff, ok := locateTCP(raw)
+func processTCP(resolve func(string) (*config.Strategy, bool), raw []byte) Verdict {
+	_, _, l4Off, tcpOff, ok := locateTCP(raw)
 	if !ok {
 		return VerdictAccept
 	}
@@ -16,232 +19,144 @@ func processTCP(match func(string) bool, raw []byte) Verdict {
 	if len(data) == 0 {
 		return VerdictContinue
 	}
-	if p, ok := findTLSClientHelloStart(data); ok {
-		host, off, ln, ok := parseSNIAndOffset(data[p:])
-		if !ok || host == "" {
-			return VerdictContinue
-		}
-		if !match(host) {
-			return VerdictContinue
-		}
-		if ip6 {
-			return verdictTCPv6(raw, ihl, tcpOff, p, off, ln)
-		}
-		return verdictTCPv4(raw, ihl, tcpOff, p, off, ln)
+	h, err := tlshello.ParseRecords(data)
+	if err != nil {
+		return VerdictContinue
+	}
+	st, ok := resolve(h.SNI)
+	if !ok {
+		return VerdictContinue
 	}
-	return VerdictContinue
+	return verdictTCP(st, raw, l4Off, tcpOff, h)
 }
 
-func verdictTCPv4(raw []byte, ihl, tcpOff, chStart, sniOff, sniLen int) Verdict {
-	ip := raw[:ihl]
-	tcph := raw[ihl:tcpOff]
+// verdictTCP handles both families: for IPv6, l4Off is the end of the
+// extension header chain and ip covers the fixed header plus extensions.
+func verdictTCP(st *config.Strategy, raw []byte, l4Off, tcpOff int, h *tlshello.ClientHello) Verdict {
+	ip := raw[:l4Off]
+	tcph := raw[l4Off:tcpOff]
 	payload := raw[tcpOff:]
 
-	fakeOnce := defaultFakeSNISeqLen
-	for i := 0; i < fakeOnce; i++ {
-		fp := buildFakeTLSv4(ip, tcph, uint32(defaultFakeSeqOffset))
-		if len(fp) != 0 {
-			_ = sendRaw(fp)
-		}
-	}
-	log.Infof("INJECT TCP fake past_seq=%d", defaultFakeSeqOffset)
-
-	pos := make([]int, 0, 2)
-	if defaultFragSNIPos > 0 && len(payload) > defaultFragSNIPos {
-		pos = append(pos, defaultFragSNIPos)
+	rec, rh := splitRecords(st, payload, h)
+	if rec != nil && !fitsPath(st, len(raw), tcpOff, rec, rh) {
+		log.Tracef("TLS records skipped: grown segment exceeds %d bytes", max(len(raw), minPathMTU))
+		rec = nil
 	}
-	if defaultFragMiddleSNI && sniLen > 0 {
-		mid := chStart + sniOff + sniLen/2
-		if mid < len(payload) {
-			if r := mid % 8; r != 0 {
-				mid += 8 - r
-				if mid >= len(payload) {
-					mid = len(payload) - 1
-				}
-			}
-			pos = append(pos, mid)
+	if rec != nil && trackShift(raw, l4Off, tcpOff, len(rec)-len(payload)) {
+		log.Infof("INJECT TLS records=%d grown=%d", len(rh.Records), len(rec)-len(payload))
+		sent, err := sendTCP(st, ip, tcph, rec, rh)
+		if err == nil {
+			return VerdictDropTrack
 		}
-	}
-	if len(pos) == 0 {
-		seg := buildTCPSegv4(ip, tcph, payload, 0, len(payload))
-		if len(seg) != 0 {
-			_ = sendRaw(seg)
-			log.Infof("INJECT TCP split passthrough len=%d", len(payload))
-			return VerdictDrop
+		log.Errorf("INJECT TCP failed after %d segments: %v", sent, err)
+		if sent > 0 {
+			// Part of the grown stream is out; the original no longer
+			// matches it, so wait for the retransmission and rewrite that.
+			return VerdictDropTrack
 		}
+		untrackShift(raw, l4Off)
 		return VerdictAccept
 	}
-	if len(pos) == 1 {
-		a := clamp(pos[0], 1, len(payload)-1)
-		s1 := buildTCPSegv4(ip, tcph, payload, 0, a)
-		s2 := buildTCPSegv4Seq(ip, tcph, payload, a, len(payload), uint32(a))
-		log.Infof("INJECT TCP split pos=%d reverse=%t", a, defaultFragSNIReverse)
-		if defaultFragSNIReverse {
-			if len(s2) != 0 {
-				_ = sendRaw(s2)
-			}
-			if defaultSeg2Delay > 0 {
-				time.Sleep(defaultSeg2Delay)
-			}
-			if len(s1) != 0 {
-				_ = sendRaw(s1)
-			}
-		} else {
-			if len(s1) != 0 {
-				_ = sendRaw(s1)
-			}
-			if defaultSeg2Delay > 0 {
-				time.Sleep(defaultSeg2Delay)
-			}
-			if len(s2) != 0 {
-				_ = sendRaw(s2)
-			}
-		}
-		return VerdictDrop
-	}
-	if pos[0] > pos[1] {
-		pos[0], pos[1] = pos[1], pos[0]
-	}
-	a := clamp(pos[0], 1, len(payload)-2)
-	b := clamp(pos[1], a+1, len(payload)-1)
-	s1 := buildTCPSegv4(ip, tcph, payload, 0, a)
-	s2 := buildTCPSegv4Seq(ip, tcph, payload, a, b, uint32(a))
-	s3 := buildTCPSegv4Seq(ip, tcph, payload, b, len(payload), uint32(b))
-	log.Infof("INJECT TCP split3 a=%d b=%d reverse=%t", a, b, defaultFragSNIReverse)
-	if defaultFragSNIReverse {
-		if len(s3) != 0 {
-			_ = sendRaw(s3)
-		}
-		if defaultSeg2Delay > 0 {
-			time.Sleep(defaultSeg2Delay)
-		}
-		if len(s2) != 0 {
-			_ = sendRaw(s2)
-		}
-		if len(s1) != 0 {
-			_ = sendRaw(s1)
-		}
-	} else {
-		if len(s1) != 0 {
-			_ = sendRaw(s1)
-		}
-		if defaultSeg2Delay > 0 {
-			time.Sleep(defaultSeg2Delay)
-		}
-		if len(s2) != 0 {
-			_ = sendRaw(s2)
-		}
-		if len(s3) != 0 {
-			_ = sendRaw(s3)
-		}
+	if sent, err := sendTCP(st, ip, tcph, payload, h); err != nil {
+		// Segments already sent carry the same bytes as the original.
+		log.Errorf("INJECT TCP failed after %d segments: %v", sent, err)
+		return VerdictAccept
 	}
 	return VerdictDrop
 }
 
-func verdictTCPv6(raw []byte, ihl, tcpOff, chStart, sniOff, sniLen int) Verdict {
-	return VerdictAccept
-}
+// minPathMTU is the packet size every path is assumed to carry: the IPv6
+// minimum MTU, which IPv4 paths carry in practice as well.
+const minPathMTU = 1280
 
-func findTLSClientHelloStart(b []byte) (int, bool) {
-	for i := 0; i+6 < len(b); i++ {
-		if b[i] != 0x16 {
-			continue
-		}
-		if b[i+1] != 0x03 {
-			continue
-		}
-		if b[i+5] == 0x01 {
-			return i, true
+// fitsPath reports whether every segment sendTCP would send for the grown
+// payload is no bigger than the original packet of rawLen bytes, or than
+// minPathMTU. Larger ones may not reach the server, and sendRaw refuses
+// them outright when they exceed the interface MTU.
+func fitsPath(st *config.Strategy, rawLen, hdrLen int, payload []byte, h *tlshello.ClientHello) bool {
+	limit := max(rawLen, minPathMTU)
+	prev := 0
+	for _, p := range append(splitPositions(st, payload, h), len(payload)) {
+		if hdrLen+p-prev > limit {
+			return false
 		}
+		prev = p
 	}
-	return 0, false
+	return true
 }
 
-func parseSNIAndOffset(data []byte) (string, int, int, bool) {
-	if len(data) < 11 {
-		return "", 0, 0, false
-	}
-	if data[0] != 0x16 {
-		return "", 0, 0, false
-	}
-	if data[5] != 0x01 {
-		return "", 0, 0, false
-	}
-	hs := data[5:]
-	if len(hs) < 4 {
-		return "", 0, 0, false
-	}
-	msgLen := int(hs[1])<<16 | int(hs[2])<<8 | int(hs[3])
-	if 4+msgLen > len(hs) {
-		return "", 0, 0, false
-	}
-	p := hs[4:]
-	if len(p) < 34 {
-		return "", 0, 0, false
+// sendTCP sends the fakes of st followed by payload, split into TCP
+// segments as configured, in place of the original segment. On failure it
+// returns how many of the payload segments went out before.
+func sendTCP(st *config.Strategy, ip, tcph, payload []byte, h *tlshello.ClientHello) (int, error) {
+	ttl := fakeTTL(st, ip)
+	for i := 0; i < st.FakeSNISeqLen; i++ {
+		fp := buildFakeTLS(st, ip, tcph, fakePayload(st, len(payload)), ttl)
+		if len(fp) != 0 {
+			_ = sendRaw(fp)
+		}
 	}
-	p = p[34:]
-	if len(p) < 1 {
-		return "", 0, 0, false
+	if st.FakeSNISeqLen > 0 {
+		log.Infof("INJECT TCP fake past_seq=%d ttl=%d", st.FakeSeqOffset, ttl)
 	}
-	sidLen := int(p[0])
-	p = p[1:]
-	if len(p) < sidLen+2 {
-		return "", 0, 0, false
+
+	pos := splitPositions(st, payload, h)
+	if len(pos) == 0 {
+		if err := sendRaw(buildTCPSeg(ip, tcph, payload, 0, len(payload))); err != nil {
+			return 0, err
+		}
+		log.Infof("INJECT TCP split passthrough len=%d", len(payload))
+		return 1, nil
 	}
-	p = p[sidLen:]
-	cl := int(binary.BigEndian.Uint16(p[:2]))
-	p = p[2:]
-	if len(p) < cl+1 {
-		return "", 0, 0, false
+	segs := make([][]byte, 0, len(pos)+1)
+	prev := 0
+	for _, p := range append(pos, len(payload)) {
+		segs = append(segs, buildTCPSegSeq(ip, tcph, payload, prev, p, uint32(prev)))
+		prev = p
 	}
-	p = p[cl:]
-	cml := int(p[0])
-	p = p[1:]
-	if len(p) < cml+2 {
-		return "", 0, 0, false
+	order := st.SegmentOrder(len(segs))
+	log.Infof("INJECT TCP split pos=%v order=%v", pos, order)
+	for i, n := range order {
+		if i == 1 && st.Seg2Delay > 0 {
+			time.Sleep(st.Seg2Delay)
+		}
+		if err := sendRaw(segs[n]); err != nil {
+			return i, err
+		}
 	}
-	p = p[cml:]
-	extLen := int(binary.BigEndian.Uint16(p[:2]))
-	p = p[2:]
-	if len(p) < extLen {
-		extLen = len(p)
+	return len(segs), nil
+}
+
+// splitPositions returns the sorted offsets in payload at which st splits
+// it into TCP segments: FragPos when set, else FragSNIPos and the middle of
+// the host name rounded up to 8 bytes.
+func splitPositions(st *config.Strategy, payload []byte, h *tlshello.ClientHello) []int {
+	if !st.FragTCP {
+		return nil
 	}
-	q := p[:extLen]
-	base := len(data) - len(q)
-	for len(q) >= 4 {
-		et := int(binary.BigEndian.Uint16(q[:2]))
-		el := int(binary.BigEndian.Uint16(q[2:4]))
-		q = q[4:]
-		if el > len(q) {
-			break
-		}
-		if et == 0 {
-			if el < 5 {
-				return "", 0, 0, false
+	var pos []int
+	if len(st.FragPos) > 0 {
+		for _, p := range st.FragPos {
+			if off, ok := p.Resolve(h, len(payload)); ok {
+				pos = append(pos, off)
 			}
-			lv := int(binary.BigEndian.Uint16(q[:2]))
-			if 2+lv > el {
-				return "", 0, 0, false
-			}
-			r := q[2 : 2+lv]
-			if len(r) < 3 {
-				return "", 0, 0, false
-			}
-			if r[0] != 0x00 {
-				return "", 0, 0, false
-			}
-			hn := int(binary.BigEndian.Uint16(r[1:3]))
-			if 3+hn > len(r) {
-				return "", 0, 0, false
+		}
+	} else {
+		if st.FragSNIPos > 0 && len(payload) > st.FragSNIPos {
+			pos = append(pos, st.FragSNIPos)
+		}
+		if st.FragMiddleSNI && h.SNILen > 0 {
+			mid := h.HostOffset(h.SNILen / 2)
+			if mid < len(payload) {
+				if r := mid % 8; r != 0 {
+					mid = min(mid+8-r, len(payload)-1)
+				}
+				pos = append(pos, mid)
 			}
-			name := r[3 : 3+hn]
-			off := base + 2 + 1 + 2
-			return string(name), off, hn, true
 		}
-		q = q[el:]
-		base += 4 + el
 	}
-	return "", 0, 0, false
+	slices.Sort(pos)
+	return slices.Compact(pos)
 }
 
 func locateTCP(pkt []byte) (bool, bool, int, int, bool) {
@@ -275,10 +190,13 @@ func locateTCP(pkt []byte) (bool, bool, int, int, bool) {
 					return false, true, 0, 0, false
 				}
 				doff := (int(pkt[off+12]) >> 4) * 4
-				return false, true, 40, off + doff, true
+				if len(pkt) < off+doff {
+					return false, true, 0, 0, false
+				}
+				return false, true, off, off + doff, true
 			}
 			switch next {
-			case 0:
+			case 0, 43, 60:
 				if len(pkt) < off+8 {
 					return false, true, 0, 0, false
 				}
@@ -286,20 +204,14 @@ func locateTCP(pkt []byte) (bool, bool, int, int, bool) {
 				if nn == 0 {
 					return false, true, 0, 0, false
 				}
-				l := int(binary.BigEndian.Uint16(pkt[off+6 : off+8]))
 				next = nn
-				off += l
-			case 43, 44, 51, 50, 60:
+				off += (int(pkt[off+1]) + 1) * 8
+			case 51:
 				if len(pkt) < off+8 {
 					return false, true, 0, 0, false
 				}
-				nn := int(pkt[off])
-				if nn == 0 {
-					return false, true, 0, 0, false
-				}
-				l := int(binary.BigEndian.Uint16(pkt[off+6 : off+8]))
-				next = nn
-				off += l
+				next = int(pkt[off])
+				off += (int(pkt[off+1]) + 2) * 4
 			default:
 				return false, true, 0, 0, false
 			}
@@ -308,7 +220,7 @@ func locateTCP(pkt []byte) (bool, bool, int, int, bool) {
 	return false, false, 0, 0, false
 }
 
-func buildTCPSegv4(ip, tcph, data []byte, a, b int) []byte {
+func buildTCPSeg(ip, tcph, data []byte, a, b int) []byte {
 	if a < 0 || b > len(data) || a >= b {
 		return nil
 	}
@@ -316,58 +228,58 @@ func buildTCPSegv4(ip, tcph, data []byte, a, b int) []byte {
 	copy(seg, ip)
 	copy(seg[len(ip):], tcph)
 	copy(seg[len(ip)+len(tcph):], data[a:b])
-	nip := seg[:len(ip)]
-	ntcp := seg[len(ip) : len(ip)+len(tcph)]
-	binary.BigEndian.PutUint16(nip[2:4], uint16(len(seg)))
-	sum := tcpChecksumIPv4(nip, ntcp, seg[len(ip)+len(tcph):])
-	binary.BigEndian.PutUint16(ntcp[16:18], sum)
-	nip[10], nip[11] = 0, 0
-	putIPChecksum(nip)
+	finishTCPSeg(seg, len(ip), len(tcph))
 	return seg
 }
 
-func buildTCPSegv4Seq(ip, tcph, data []byte, a, b int, seqDelta uint32) []byte {
-	seg := buildTCPSegv4(ip, tcph, data, a, b)
+func buildTCPSegSeq(ip, tcph, data []byte, a, b int, seqDelta uint32) []byte {
+	seg := buildTCPSeg(ip, tcph, data, a, b)
 	if seg == nil {
 		return nil
 	}
 	ntcp := seg[len(ip) : len(ip)+len(tcph)]
 	seq := binary.BigEndian.Uint32(ntcp[4:8])
 	binary.BigEndian.PutUint32(ntcp[4:8], seq+seqDelta)
-	sum := tcpChecksumIPv4(seg[:len(ip)], ntcp, seg[len(ip)+len(tcph):])
-	binary.BigEndian.PutUint16(ntcp[16:18], sum)
+	finishTCPSeg(seg, len(ip), len(tcph))
 	return seg
 }
 
-func buildFakeTLSv4(ip, tcph []byte, past uint32) []byte {
-	fakeLen := 560
-	data := make([]byte, fakeLen)
-	data[0] = 0x16
-	data[1], data[2] = 0x03, 0x01
-	data[3], data[4] = byte(fakeLen-5>>8), byte((fakeLen-5)&0xff)
-	data[5] = 0x01
-	copy(data[6:], make([]byte, fakeLen-6))
+// buildFakeTLS builds a fake segment carrying data from the original headers,
+// fooled as configured in st: past sequence number, TTL, header options and
+// checksum.
+func buildFakeTLS(st *config.Strategy, ip, tcph, data []byte, ttl uint8) []byte {
+	if st.FakeMD5Sig {
+		tcph = withMD5Sig(tcph)
+	}
 	seg := make([]byte, len(ip)+len(tcph)+len(data))
 	copy(seg, ip)
 	copy(seg[len(ip):], tcph)
 	copy(seg[len(ip)+len(tcph):], data)
+	setTTL(seg, ttl)
 	ntcp := seg[len(ip) : len(ip)+len(tcph)]
 	seq := binary.BigEndian.Uint32(ntcp[4:8])
-	binary.BigEndian.PutUint32(ntcp[4:8], seq-uint32(past))
-	binary.BigEndian.PutUint16(seg[2:4], uint16(len(seg)))
-	sum := tcpChecksumIPv4(seg[:len(ip)], ntcp, data)
-	binary.BigEndian.PutUint16(ntcp[16:18], sum)
-	seg[10], seg[11] = 0, 0
-	putIPChecksum(seg[:len(ip)])
+	binary.BigEndian.PutUint32(ntcp[4:8], seq-uint32(st.FakeSeqOffset))
+	foolTCP(st, ntcp)
+	finishTCPSeg(seg, len(ip), len(tcph))
+	if st.FakeBadSum {
+		breakTCPChecksum(seg, len(ip))
+	}
 	return seg
 }
 
-func clamp(v, lo, hi int) int {
-	if v < lo {
-		return lo
+// finishTCPSeg fixes the IP length field, the TCP checksum and, for IPv4, the
+// header checksum of a segment assembled from copied headers.
+func finishTCPSeg(seg []byte, ipLen, tcpLen int) {
+	nip := seg[:ipLen]
+	ntcp := seg[ipLen : ipLen+tcpLen]
+	data := seg[ipLen+tcpLen:]
+	if nip[0]>>4 == 6 {
+		binary.BigEndian.PutUint16(nip[4:6], uint16(len(seg)-40))
+		binary.BigEndian.PutUint16(ntcp[16:18], tcpChecksumIPv6(nip, ntcp, data))
+		return
 	}
-	if v > hi {
-		return hi
-	}
-	return v
+	binary.BigEndian.PutUint16(nip[2:4], uint16(len(seg)))
+	binary.BigEndian.PutUint16(ntcp[16:18], tcpChecksumIPv4(nip, ntcp, data))
+	nip[10], nip[11] = 0, 0
+	putIPChecksum(nip)
 }
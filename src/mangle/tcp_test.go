@@ -0,0 +1,77 @@
+package mangle
+
+import (
+	"encoding/binary"
+	"strings"
+	"testing"
+
+	"github.com/daniellavrushin/b4/config"
+	"github.com/daniellavrushin/b4/tlshello"
+)
+
+// tcpPacket builds an IPv4 segment from 192.0.2.1:40000 to 198.51.100.1:443.
+func tcpPacket(seq uint32, flags byte, payload []byte) []byte {
+	pkt := make([]byte, 40, 40+len(payload))
+	pkt[0], pkt[8], pkt[9] = 0x45, 64, 6
+	copy(pkt[12:16], []byte{192, 0, 2, 1})
+	copy(pkt[16:20], []byte{198, 51, 100, 1})
+	tcph := pkt[20:]
+	binary.BigEndian.PutUint16(tcph[0:2], 40000)
+	binary.BigEndian.PutUint16(tcph[2:4], 443)
+	binary.BigEndian.PutUint32(tcph[4:8], seq)
+	tcph[12], tcph[13] = 5<<4, flags
+	pkt = append(pkt, payload...)
+	finishTCPSeg(pkt, 20, 20)
+	return pkt
+}
+
+func TestFitsPath(t *testing.T) {
+	msg := helloMsg("video.example.com")
+	big := helloMsg(strings.Repeat("a", 1400) + ".example.com")
+
+	tests := []struct {
+		name string
+		st   config.Strategy
+		msg  []byte
+		want bool
+	}{
+		{"small hello", config.Strategy{TLSRecSNI: true}, msg, true},
+		{"full segment, no TCP split", config.Strategy{TLSRecSNI: true}, big, false},
+		{"full segment, TCP split", config.Strategy{TLSRecSNI: true, FragTCP: true, FragMiddleSNI: true}, big, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			in := wrapRecords(tt.msg)
+			h, err := tlshello.ParseRecords(in)
+			if err != nil {
+				t.Fatal(err)
+			}
+			rec, rh := splitRecords(&tt.st, in, h)
+			if rec == nil {
+				t.Fatal("not split")
+			}
+			if got := fitsPath(&tt.st, 40+len(in), 40, rec, rh); got != tt.want {
+				t.Errorf("fitsPath = %t for %d bytes grown to %d", got, 40+len(in), 40+len(rec))
+			}
+		})
+	}
+}
+
+// Without raw sockets every injection fails, as it would for a segment
+// over the MTU: the original must go out and leave no shift behind.
+func TestVerdictTCPInjectFailure(t *testing.T) {
+	in := wrapRecords(helloMsg("video.example.com"))
+	for _, st := range []config.Strategy{{TLSRecSNI: true}, {FragTCP: true, FragMiddleSNI: true}} {
+		raw := tcpPacket(1000, tcpFlagACK, in)
+		h, err := tlshello.ParseRecords(raw[40:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if v := verdictTCP(&st, raw, 20, 40, h); v != VerdictAccept {
+			t.Errorf("%+v: verdict %d, want accept", st, v)
+		}
+		if _, ok := shiftTable.m[segmentFlow(raw, 20, false)]; ok {
+			t.Errorf("%+v: shift left behind", st)
+		}
+	}
+}
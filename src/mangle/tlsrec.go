@@ -0,0 +1,63 @@
+package mangle
+
+import (
+	"slices"
+
+	"github.com/daniellavrushin/b4/config"
+	"github.com/daniellavrushin/b4/tlshello"
+)
+
+// splitRecords rewrites the records holding the ClientHello into more
+// records, cut in the middle of the host name and TLSRecPos bytes into the
+// handshake message, and returns the new payload with the hello parsed from
+// it. Cuts are mapped through the records the client already used, so a
+// fragmented hello is split further. A record that continues in later
+// segments is cut as well; its last piece keeps declaring the remainder. It
+// returns nil when there is nothing to cut.
+func splitRecords(st *config.Strategy, payload []byte, h *tlshello.ClientHello) ([]byte, *tlshello.ClientHello) {
+	var cuts []int
+	if st.TLSRecSNI && h.SNILen > 0 {
+		cuts = append(cuts, h.HostOffset(h.SNILen/2))
+	}
+	if st.TLSRecPos > 0 {
+		cuts = append(cuts, h.Offset(st.TLSRecPos))
+	}
+	slices.Sort(cuts)
+	cuts = slices.Compact(cuts)
+
+	out := make([]byte, 0, len(payload)+5*len(cuts))
+	prev, split := 0, false
+	for _, r := range h.Records {
+		body := r.Off + 5
+		end := min(body+r.Len, len(payload))
+		out = append(out, payload[prev:r.Off]...)
+		hdr := payload[r.Off : r.Off+3]
+		start := body
+		for _, c := range cuts {
+			if c <= start || c >= end {
+				continue
+			}
+			out = appendRecord(out, hdr, c-start, payload[start:c])
+			start, split = c, true
+		}
+		out = appendRecord(out, hdr, r.Len-(start-body), payload[start:end])
+		prev = end
+	}
+	if !split {
+		return nil, nil
+	}
+	out = append(out, payload[prev:]...)
+
+	nh, err := tlshello.ParseRecords(out)
+	if err != nil {
+		return nil, nil
+	}
+	return out, nh
+}
+
+// appendRecord appends a record with the type and version of hdr declaring n
+// bytes, of which body is present.
+func appendRecord(out, hdr []byte, n int, body []byte) []byte {
+	out = append(out, hdr[0], hdr[1], hdr[2], byte(n>>8), byte(n))
+	return append(out, body...)
+}
@@ -0,0 +1,173 @@
+package mangle
+
+import (
+	"bytes"
+	"slices"
+	"testing"
+
+	"github.com/daniellavrushin/b4/config"
+	"github.com/daniellavrushin/b4/tlshello"
+)
+
+// helloMsg builds a ClientHello handshake message carrying only a
+// server_name extension for host.
+func helloMsg(host string) []byte {
+	n := len(host)
+	sni := []byte{0, 0, byte((n + 5) >> 8), byte(n + 5), byte((n + 3) >> 8), byte(n + 3), 0, byte(n >> 8), byte(n)}
+	sni = append(sni, host...)
+	body := append([]byte{3, 3}, make([]byte, 32)...)
+	body = append(body, 0, 0, 2, 0x13, 0x01, 1, 0, byte(len(sni)>>8), byte(len(sni)))
+	body = append(body, sni...)
+	return append([]byte{tlshello.TypeClientHello, 0, byte(len(body) >> 8), byte(len(body))}, body...)
+}
+
+// wrapRecords puts msg into handshake records cut at the given offsets.
+func wrapRecords(msg []byte, cuts ...int) []byte {
+	var out []byte
+	prev := 0
+	for _, c := range append(cuts, len(msg)) {
+		out = append(out, tlshello.ContentTypeHandshake, 3, 1, byte((c-prev)>>8), byte(c-prev))
+		out = append(out, msg[prev:c]...)
+		prev = c
+	}
+	return out
+}
+
+// unwrapRecords returns the declared record lengths and the concatenated
+// record payloads present in b.
+func unwrapRecords(b []byte) ([]int, []byte) {
+	var lens []int
+	var msg []byte
+	for len(b) >= 5 {
+		n := int(b[3])<<8 | int(b[4])
+		lens = append(lens, n)
+		b = b[5:]
+		msg = append(msg, b[:min(n, len(b))]...)
+		b = b[min(n, len(b)):]
+	}
+	return lens, msg
+}
+
+func TestSplitRecords(t *testing.T) {
+	const host = "video.example.com"
+	msg := helloMsg(host)
+	sniAt := bytes.Index(msg, []byte(host))
+	mid := sniAt + len(host)/2
+
+	tests := []struct {
+		name string
+		st   config.Strategy
+		in   []byte
+		lens []int // declared record lengths after the split, nil for none
+	}{
+		{
+			name: "single record",
+			st:   config.Strategy{TLSRecSNI: true},
+			in:   wrapRecords(msg),
+			lens: []int{mid, len(msg) - mid},
+		},
+		{
+			name: "two records, host in the second",
+			st:   config.Strategy{TLSRecSNI: true},
+			in:   wrapRecords(msg, 20),
+			lens: []int{20, mid - 20, len(msg) - mid},
+		},
+		{
+			name: "two records cut inside the host",
+			st:   config.Strategy{TLSRecSNI: true},
+			in:   wrapRecords(msg, sniAt+3),
+			lens: []int{sniAt + 3, mid - sniAt - 3, len(msg) - mid},
+		},
+		{
+			name: "position in the second record",
+			st:   config.Strategy{TLSRecPos: 30},
+			in:   wrapRecords(msg, 20),
+			lens: []int{20, 10, len(msg) - 30},
+		},
+		{
+			name: "both cuts",
+			st:   config.Strategy{TLSRecSNI: true, TLSRecPos: 10},
+			in:   wrapRecords(msg, 20),
+			lens: []int{10, 10, mid - 20, len(msg) - mid},
+		},
+		{
+			name: "record continues in the next segment",
+			st:   config.Strategy{TLSRecPos: 30},
+			in:   wrapRecords(msg)[:5+40],
+			lens: []int{30, len(msg) - 30},
+		},
+		{
+			name: "cut on an existing boundary",
+			st:   config.Strategy{TLSRecPos: 20},
+			in:   wrapRecords(msg, 20),
+		},
+		{
+			name: "cut past the segment",
+			st:   config.Strategy{TLSRecPos: len(msg) - 2},
+			in:   wrapRecords(msg)[:40],
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h, err := tlshello.ParseRecords(tt.in)
+			if err != nil {
+				t.Fatal(err)
+			}
+			out, nh := splitRecords(&tt.st, tt.in, h)
+			if tt.lens == nil {
+				if out != nil {
+					lens, _ := unwrapRecords(out)
+					t.Fatalf("split into %v, want none", lens)
+				}
+				return
+			}
+			if out == nil {
+				t.Fatal("not split")
+			}
+			lens, got := unwrapRecords(out)
+			if !slices.Equal(lens, tt.lens) {
+				t.Errorf("record lengths %v, want %v", lens, tt.lens)
+			}
+			if _, want := unwrapRecords(tt.in); !bytes.Equal(got, want) {
+				t.Errorf("handshake bytes changed")
+			}
+			if nh.SNI != host && !nh.Truncated {
+				t.Errorf("reparsed SNI %q", nh.SNI)
+			}
+			if len(out)-len(tt.in) != 5*(len(tt.lens)-len(h.Records)) {
+				t.Errorf("grew by %d bytes for %d records", len(out)-len(tt.in), len(tt.lens))
+			}
+		})
+	}
+}
+
+func TestSplitRecordsFragPositions(t *testing.T) {
+	const host = "video.example.com"
+	var pos tlshello.Positions
+	if err := pos.Set("sni,midsni,host_end-1,sni+3"); err != nil {
+		t.Fatal(err)
+	}
+	st := config.Strategy{TLSRecSNI: true, TLSRecPos: 20, FragTCP: true, FragPos: pos}
+	msg := helloMsg(host)
+	sniAt := bytes.Index(msg, []byte(host))
+
+	for _, in := range [][]byte{wrapRecords(msg), wrapRecords(msg, sniAt+2)} {
+		h, err := tlshello.ParseRecords(in)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rec, rh := splitRecords(&st, in, h)
+		if rec == nil {
+			t.Fatal("not split")
+		}
+		got := splitPositions(&st, rec, rh)
+		if len(got) != 4 {
+			t.Fatalf("positions %v, want 4", got)
+		}
+		for i, want := range []byte{host[0], host[3], host[len(host)/2], host[len(host)-1]} {
+			if rec[got[i]] != want {
+				t.Errorf("%d records: position %d at %d points at %q, want %q", len(h.Records), i, got[i], rec[got[i]], want)
+			}
+		}
+	}
+}
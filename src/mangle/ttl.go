@@ -0,0 +1,112 @@
+package mangle
+
+import (
+	"net/netip"
+	"sync"
+	"time"
+
+	"github.com/daniellavrushin/b4/config"
+)
+
+// hopCache remembers how many hops away each server is, as derived from the
+// TTL of its SYN-ACKs, for strategies with an automatic fake TTL.
+var hopCache = struct {
+	mu sync.Mutex
+	m  map[netip.Addr]hopEntry
+}{m: make(map[netip.Addr]hopEntry)}
+
+type hopEntry struct {
+	hops uint8
+	seen time.Time
+}
+
+const (
+	hopCacheMax = 16384
+	hopCacheTTL = 30 * time.Minute
+)
+
+// ObserveServerTTL records the TTL or hop limit of a SYN-ACK from addr. The
+// server's initial TTL is assumed to be the nearest common default (64, 128
+// or 255) at or above the observed value. A router sniffing both WAN and LAN
+// sees the same SYN-ACK again one hop later, so a fresh entry only ever
+// shrinks.
+func ObserveServerTTL(addr netip.Addr, ttl uint8) {
+	if !addr.IsValid() || ttl == 0 {
+		return
+	}
+	var initial uint8 = 255
+	switch {
+	case ttl <= 64:
+		initial = 64
+	case ttl <= 128:
+		initial = 128
+	}
+	addr = addr.Unmap()
+	hops := initial - ttl
+	now := time.Now()
+	hopCache.mu.Lock()
+	defer hopCache.mu.Unlock()
+	e, ok := hopCache.m[addr]
+	if ok && now.Sub(e.seen) <= hopCacheTTL && e.hops <= hops {
+		return
+	}
+	if !ok && len(hopCache.m) >= hopCacheMax {
+		for a, e := range hopCache.m {
+			if now.Sub(e.seen) > hopCacheTTL {
+				delete(hopCache.m, a)
+			}
+		}
+		if len(hopCache.m) >= hopCacheMax {
+			return
+		}
+	}
+	hopCache.m[addr] = hopEntry{hops: hops, seen: now}
+}
+
+func serverHops(addr netip.Addr) (uint8, bool) {
+	hopCache.mu.Lock()
+	defer hopCache.mu.Unlock()
+	e, ok := hopCache.m[addr.Unmap()]
+	if !ok || time.Since(e.seen) > hopCacheTTL {
+		return 0, false
+	}
+	return e.hops, true
+}
+
+// fakeTTL picks the TTL for fakes sent to the destination of the IP header
+// ip: the server's hop distance minus FakeAutoTTL when it is known, else the
+// fixed FakeTTL. 0 keeps the TTL of the original packet.
+func fakeTTL(st *config.Strategy, ip []byte) uint8 {
+	if st.FakeAutoTTL > 0 {
+		if hops, ok := serverHops(dstAddr(ip)); ok {
+			if int(hops) > st.FakeAutoTTL {
+				return hops - uint8(st.FakeAutoTTL)
+			}
+			return 1
+		}
+	}
+	return uint8(st.FakeTTL)
+}
+
+func dstAddr(ip []byte) netip.Addr {
+	if len(ip) >= 40 && ip[0]>>4 == 6 {
+		return netip.AddrFrom16([16]byte(ip[24:40]))
+	}
+	if len(ip) >= 20 {
+		return netip.AddrFrom4([4]byte(ip[16:20]))
+	}
+	return netip.Addr{}
+}
+
+// setTTL overwrites the IPv4 TTL or IPv6 hop limit; callers fix the IPv4
+// header checksum afterwards.
+func setTTL(ip []byte, ttl uint8) {
+	if ttl == 0 {
+		return
+	}
+	if ip[0]>>4 == 6 {
+		ip[7] = ttl
+		return
+	}
+	ip[8] = ttl
+}
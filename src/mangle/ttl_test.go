@@ -0,0 +1,28 @@
+package mangle
+
+import (
+	"net/netip"
+	"testing"
+)
+
+func TestObserveServerTTL(t *testing.T) {
+	addr := netip.MustParseAddr("192.0.2.7")
+	for _, tt := range []struct {
+		ttl  uint8
+		want uint8
+	}{
+		{52, 12}, // seen on WAN
+		{51, 12}, // the same SYN-ACK forwarded to the LAN bridge
+		{54, 10}, // a shorter route
+		{116, 10},
+	} {
+		ObserveServerTTL(addr, tt.ttl)
+		if got, ok := serverHops(addr); !ok || got != tt.want {
+			t.Errorf("after TTL %d: hops = %d, %t, want %d", tt.ttl, got, ok, tt.want)
+		}
+	}
+	ObserveServerTTL(netip.MustParseAddr("::ffff:192.0.2.8"), 120)
+	if got, ok := serverHops(netip.MustParseAddr("192.0.2.8")); !ok || got != 8 {
+		t.Errorf("mapped address: hops = %d, %t, want 8", got, ok)
+	}
+}
@@ -3,10 +3,12 @@ package mangle
 import (
 	"encoding/binary"
 
+	"github.com/daniellavrushin/b4/config"
+	"github.com/daniellavrushin/b4/log"
 	"github.com/daniellavrushin/b4/sni"
 )
 
-func processUDP(match func(string) bool, raw []byte, v6 bool) Verdict {
+func processUDP(resolve func(string) (*config.Strategy, bool), raw []byte, v6 bool) Verdict {
 	ip4 := !v6
 	ihl := 20
 	off := 0
@@ -37,22 +39,31 @@ func processUDP(match func(string) bool, raw []byte, v6 bool) Verdict {
 		return VerdictAccept
 	}
 	host, ok := sni.ParseQUICClientHelloSNI(data)
-	if !ok || host == "" {
+	if !ok {
 		return VerdictAccept
 	}
-	if !match(host) {
+	st, ok := resolve(host)
+	if !ok {
 		return VerdictAccept
 	}
+	switch st.UDPMode {
+	case config.UDPModeDrop:
+		log.Infof("DROP QUIC Initial sni=%s", host)
+		return VerdictDrop
+	case config.UDPModeNone:
+		return VerdictAccept
+	}
+	ttl := fakeTTL(st, raw)
 	if ip4 {
-		for i := 0; i < defaultUDPFakeSeqLen; i++ {
-			fp := buildFakeUDPv4(raw[:ihl], raw[off:off+8], defaultUDPFakeLen, defaultUDPFakingChecksum)
+		for i := 0; i < st.UDPFakeSeqLen; i++ {
+			fp := buildFakeUDPv4(raw[:ihl], raw[off:off+8], st.UDPFakeLen, st.UDPFakingChecksum, ttl)
 			if len(fp) != 0 {
 				_ = sendRaw(fp)
 			}
 		}
 	} else {
-		for i := 0; i < defaultUDPFakeSeqLen; i++ {
-			fp := buildFakeUDPv6(raw[:40], raw[off:off+8], defaultUDPFakeLen, defaultUDPFakingChecksum)
+		for i := 0; i < st.UDPFakeSeqLen; i++ {
+			fp := buildFakeUDPv6(raw[:40], raw[off:off+8], st.UDPFakeLen, st.UDPFakingChecksum, ttl)
 			if len(fp) != 0 {
 				_ = sendRaw(fp)
 			}
@@ -61,7 +72,7 @@ func processUDP(match func(string) bool, raw []byte, v6 bool) Verdict {
 	return VerdictAccept
 }
 
-func buildFakeUDPv4(ip, udph []byte, dlen int, breakChecksum bool) []byte {
+func buildFakeUDPv4(ip, udph []byte, dlen int, breakChecksum bool, ttl uint8) []byte {
 	if dlen < 0 {
 		dlen = 0
 	}
@@ -80,20 +91,23 @@ func buildFakeUDPv4(ip, udph []byte, dlen int, breakChecksum bool) []byte {
 		check++
 	}
 	binary.BigEndian.PutUint16(u[6:8], check)
+	setTTL(seg, ttl)
 	seg[10], seg[11] = 0, 0
 	putIPChecksum(seg[:len(ip)])
 	return seg
 }
 
-func buildFakeUDPv6(ip6, udph []byte, dlen int, breakChecksum bool) []byte {
+func buildFakeUDPv6(ip6, udph []byte, dlen int, breakChecksum bool, ttl uint8) []byte {
 	seg := make([]byte, len(ip6)+len(udph)+dlen)
 	copy(seg, ip6)
 	copy(seg[len(ip6):], udph)
 	for i := 0; i < dlen; i++ {
 		seg[len(ip6)+len(udph)+i] = 0
 	}
-	binary.BigEndian.PutUint16(seg[len(ip6):len(ip6)+4], uint16(len(udph)+dlen))
+	binary.BigEndian.PutUint16(seg[4:6], uint16(len(udph)+dlen))
+	setTTL(seg, ttl)
 	u := seg[len(ip6):]
+	binary.BigEndian.PutUint16(u[4:6], uint16(len(udph)+dlen))
 	u[6], u[7] = 0, 0
 	check := udpChecksumIPv6(seg[:len(ip6)], u, seg[len(ip6)+len(udph):])
 	if breakChecksum {
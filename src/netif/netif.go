@@ -0,0 +1,109 @@
+//go:build linux
+
+// Package netif detects the LAN and WAN interfaces of a router from the
+// kernel routing table.
+package netif
+
+import (
+	"encoding/binary"
+	"net"
+	"net/netip"
+	"slices"
+	"syscall"
+)
+
+const rtTableMain = 254
+
+// DefaultRouteIfaces returns the interfaces that carry an IPv4 or IPv6
+// default route in the main routing table, as reported over rtnetlink.
+func DefaultRouteIfaces() ([]string, error) {
+	var out []string
+	for _, family := range []int{syscall.AF_INET, syscall.AF_INET6} {
+		idx, err := defaultRouteIndexes(family)
+		if err != nil {
+			return nil, err
+		}
+		for _, i := range idx {
+			ifi, err := net.InterfaceByIndex(i)
+			if err != nil || slices.Contains(out, ifi.Name) {
+				continue
+			}
+			out = append(out, ifi.Name)
+		}
+	}
+	return out, nil
+}
+
+func defaultRouteIndexes(family int) ([]int, error) {
+	b, err := syscall.NetlinkRIB(syscall.RTM_GETROUTE, family)
+	if err != nil {
+		return nil, err
+	}
+	msgs, err := syscall.ParseNetlinkMessage(b)
+	if err != nil {
+		return nil, err
+	}
+	var out []int
+	for _, m := range msgs {
+		if m.Header.Type != syscall.RTM_NEWROUTE || len(m.Data) < syscall.SizeofRtMsg {
+			continue
+		}
+		// struct rtmsg: family, dst_len, src_len, tos, table, protocol, scope, type
+		if m.Data[1] != 0 || m.Data[7] != syscall.RTN_UNICAST {
+			continue
+		}
+		attrs, err := syscall.ParseNetlinkRouteAttr(&m)
+		if err != nil {
+			continue
+		}
+		table := int(m.Data[4])
+		oif := 0
+		for _, a := range attrs {
+			switch a.Attr.Type {
+			case syscall.RTA_TABLE:
+				if len(a.Value) >= 4 {
+					table = int(binary.NativeEndian.Uint32(a.Value))
+				}
+			case syscall.RTA_OIF:
+				if len(a.Value) >= 4 {
+					oif = int(binary.NativeEndian.Uint32(a.Value))
+				}
+			}
+		}
+		if table == rtTableMain && oif > 0 && !slices.Contains(out, oif) {
+			out = append(out, oif)
+		}
+	}
+	return out, nil
+}
+
+// LANIfaces returns the interfaces that are up, not loopback, not in skip
+// and hold a private (RFC 1918 or ULA) address.
+func LANIfaces(skip []string) ([]string, error) {
+	ifs, err := net.Interfaces()
+	if err != nil {
+		return nil, err
+	}
+	var out []string
+	for _, ifi := range ifs {
+		if ifi.Flags&net.FlagUp == 0 || ifi.Flags&net.FlagLoopback != 0 || slices.Contains(skip, ifi.Name) {
+			continue
+		}
+		addrs, err := ifi.Addrs()
+		if err != nil {
+			continue
+		}
+		for _, a := range addrs {
+			n, ok := a.(*net.IPNet)
+			if !ok {
+				continue
+			}
+			ip, ok := netip.AddrFromSlice(n.IP)
+			if ok && ip.Unmap().IsPrivate() {
+				out = append(out, ifi.Name)
+				break
+			}
+		}
+	}
+	return out, nil
+}
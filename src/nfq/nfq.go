@@ -0,0 +1,179 @@
+//go:build linux
+
+package nfq
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/daniellavrushin/b4/config"
+	"github.com/daniellavrushin/b4/log"
+	"github.com/daniellavrushin/b4/mangle"
+	"github.com/florianl/go-nfqueue"
+	"github.com/mdlayher/netlink"
+)
+
+type Pool struct {
+	cfg     *config.Config
+	rs      *mangle.Ruleset
+	workers []*worker
+	ctx     context.Context
+	cancel  context.CancelFunc
+}
+
+type worker struct {
+	num  uint16
+	mark int
+	q    *nfqueue.Nfqueue
+	proc *mangle.Processor
+}
+
+func NewPool(cfg *config.Config) *Pool {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Pool{cfg: cfg, rs: mangle.NewRuleset(cfg), ctx: ctx, cancel: cancel}
+}
+
+// Reload swaps the domain lists and strategies of every worker to cfg. Queue
+// numbers, flags and mark are fixed for the lifetime of the pool.
+func (p *Pool) Reload(cfg *config.Config) {
+	rs := mangle.NewRuleset(cfg)
+	for _, w := range p.workers {
+		w.proc.SetRuleset(rs)
+	}
+	p.rs = rs
+}
+
+// Start opens one queue per configured thread, numbered from QueueStartNum
+// to match the --queue-balance range installed by the iptables manifest.
+func (p *Pool) Start() error {
+	threads := p.cfg.Threads
+	if threads < 1 {
+		threads = 1
+	}
+	for i := 0; i < threads; i++ {
+		num := p.cfg.QueueStartNum + i
+		if num < 0 || num > 0xffff {
+			p.Stop()
+			return fmt.Errorf("queue number %d out of range", num)
+		}
+		w, err := p.startWorker(uint16(num))
+		if err != nil {
+			p.Stop()
+			return fmt.Errorf("queue %d: %w", num, err)
+		}
+		p.workers = append(p.workers, w)
+		log.Infof("NFQUEUE %d bound", num)
+	}
+	return nil
+}
+
+func (p *Pool) startWorker(num uint16) (*worker, error) {
+	flags := uint32(nfqueue.NfQaCfgFlagFailOpen)
+	if p.cfg.UseGSO {
+		flags |= nfqueue.NfQaCfgFlagGSO
+	}
+	if p.cfg.UseConntrack {
+		flags |= nfqueue.NfQaCfgFlagConntrack
+	}
+	q, err := nfqueue.Open(&nfqueue.Config{
+		NfQueue:      num,
+		MaxPacketLen: 0xffff,
+		MaxQueueLen:  4096,
+		Copymode:     nfqueue.NfQnlCopyPacket,
+		Flags:        flags,
+		WriteTimeout: 15 * time.Millisecond,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if err := q.SetOption(netlink.NoENOBUFS, true); err != nil {
+		log.Errorf("NFQUEUE %d: NoENOBUFS: %v", num, err)
+	}
+	w := &worker{num: num, mark: int(p.cfg.Mark), q: q, proc: mangle.NewProcessor(p.rs)}
+	if err := q.RegisterWithErrorFunc(p.ctx, w.handle, w.handleErr(p.ctx)); err != nil {
+		_ = q.Close()
+		return nil, err
+	}
+	return w, nil
+}
+
+// Stop cancels all queue readers and closes the netlink sockets. The kernel
+// drops packets still waiting for a verdict when a socket closes; the bypass
+// flag only lets through packets queued after that, until the rules go.
+func (p *Pool) Stop() {
+	p.cancel()
+	var wg sync.WaitGroup
+	for _, w := range p.workers {
+		wg.Add(1)
+		go func(w *worker) {
+			defer wg.Done()
+			if err := w.q.Close(); err != nil {
+				log.Errorf("NFQUEUE %d close: %v", w.num, err)
+			}
+		}(w)
+	}
+	wg.Wait()
+	p.workers = nil
+	_ = mangle.CloseRaw()
+}
+
+// handle runs on the queue's single receive goroutine, so the worker's
+// Processor is never used concurrently.
+func (w *worker) handle(a nfqueue.Attribute) int {
+	if a.PacketID == nil {
+		return 0
+	}
+	id := *a.PacketID
+	if a.Payload == nil {
+		w.setVerdict(id, nfqueue.NfAccept)
+		return 0
+	}
+	var err error
+	switch v := w.proc.Process(*a.Payload); v {
+	case mangle.VerdictModify:
+		// The mark keeps the packet out of the b4 chains it has yet to pass.
+		err = w.q.SetVerdictModPacketWithMark(id, nfqueue.NfAccept, w.mark, *a.Payload)
+	case mangle.VerdictDropTrack:
+		err = w.q.SetVerdictWithConnMark(id, nfqueue.NfDrop, w.mark)
+	default:
+		err = w.q.SetVerdict(id, nfVerdict(v))
+	}
+	if err != nil {
+		log.Errorf("NFQUEUE %d verdict id=%d: %v", w.num, id, err)
+	}
+	return 0
+}
+
+func (w *worker) handleErr(ctx context.Context) nfqueue.ErrorFunc {
+	return func(err error) int {
+		if ctx.Err() != nil {
+			return 1
+		}
+		var opErr *netlink.OpError
+		if errors.As(err, &opErr) && (opErr.Timeout() || opErr.Temporary()) {
+			return 0
+		}
+		log.Errorf("NFQUEUE %d receive: %v", w.num, err)
+		return 0
+	}
+}
+
+func (w *worker) setVerdict(id uint32, v int) {
+	if err := w.q.SetVerdict(id, v); err != nil {
+		log.Errorf("NFQUEUE %d verdict id=%d: %v", w.num, id, err)
+	}
+}
+
+func nfVerdict(v mangle.Verdict) int {
+	switch v {
+	case mangle.VerdictDrop:
+		return nfqueue.NfDrop
+	case mangle.VerdictAccept, mangle.VerdictContinue:
+		return nfqueue.NfAccept
+	default:
+		return nfqueue.NfAccept
+	}
+}
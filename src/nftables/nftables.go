@@ -0,0 +1,573 @@
+// Package nftables installs the b4 queue rules as a native nftables table,
+// for systems (OpenWrt fw4, nft-only distros) where the iptables shims are
+// missing or only translate into nftables anyway. The table is programmed
+// over netlink, so neither nft nor a shell is needed on the device.
+package nftables
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"hash/fnv"
+	"net/netip"
+	"strings"
+	"time"
+
+	"github.com/daniellavrushin/b4/cidr"
+	"github.com/daniellavrushin/b4/config"
+	"github.com/daniellavrushin/b4/log"
+	"github.com/daniellavrushin/b4/ports"
+	"github.com/daniellavrushin/b4/sysctl"
+	"github.com/google/nftables"
+	"github.com/google/nftables/binaryutil"
+	"github.com/google/nftables/expr"
+	"github.com/google/nftables/xt"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	Family = "inet"
+	Table  = "b4"
+
+	priorityMangle = -150
+)
+
+var table = &nftables.Table{Name: Table, Family: nftables.TableFamilyINet}
+
+// Available reports whether the kernel answers nf_tables netlink requests.
+func Available() bool {
+	c, err := nftables.New()
+	if err != nil {
+		return false
+	}
+	_, err = c.ListTablesOfFamily(nftables.TableFamilyINet)
+	return err == nil
+}
+
+// Rule is one rule of the b4 table: the netlink expressions that are
+// installed and the equivalent nft syntax, used for logging and printing.
+type Rule struct {
+	Text  string
+	Exprs []expr.Any
+}
+
+// rule joins rule fragments in order.
+func rule(parts ...Rule) Rule {
+	var r Rule
+	texts := make([]string, 0, len(parts))
+	for _, p := range parts {
+		if p.Text != "" {
+			texts = append(texts, p.Text)
+		}
+		r.Exprs = append(r.Exprs, p.Exprs...)
+	}
+	r.Text = strings.Join(texts, " ")
+	return r
+}
+
+// comment names the rule by a digest of its expressions, so verify can tell
+// the rules b4 installed from changed or foreign ones.
+func (r Rule) comment() string {
+	h := fnv.New64a()
+	for _, e := range r.Exprs {
+		b, _ := expr.Marshal(unix.NFPROTO_INET, e)
+		h.Write(b)
+	}
+	return "b4:" + hex.EncodeToString(h.Sum(nil))
+}
+
+// userData encodes the comment the way nft stores it.
+func (r Rule) userData() []byte {
+	c := r.comment()
+	return append([]byte{udataRuleComment, byte(len(c) + 1)}, c+"\x00"...)
+}
+
+const udataRuleComment = 0 // NFTNL_UDATA_RULE_COMMENT
+
+// Chain is one chain of the b4 table. Chains with a Hook are base chains.
+type Chain struct {
+	Name     string
+	Type     string
+	Hook     string
+	Priority int
+	Rules    []Rule
+}
+
+var hooks = map[string]*nftables.ChainHook{
+	"prerouting":  nftables.ChainHookPrerouting,
+	"postrouting": nftables.ChainHookPostrouting,
+	"output":      nftables.ChainHookOutput,
+	"input":       nftables.ChainHookInput,
+	"forward":     nftables.ChainHookForward,
+}
+
+// Set is a named set of destination addresses in the b4 table: an interval
+// set loaded with Ranges, or, with a Timeout, a set filled by Learn.
+type Set struct {
+	Name    string
+	IPv6    bool
+	Ranges  []cidr.Range
+	Timeout time.Duration
+	Size    uint32
+}
+
+func (st Set) keyType() nftables.SetDatatype {
+	if st.IPv6 {
+		return nftables.TypeIP6Addr
+	}
+	return nftables.TypeIPAddr
+}
+
+func (st Set) nset() *nftables.Set {
+	if st.Timeout > 0 {
+		return &nftables.Set{Table: table, Name: st.Name, KeyType: st.keyType(),
+			HasTimeout: true, Timeout: st.Timeout, Size: st.Size}
+	}
+	return &nftables.Set{Table: table, Name: st.Name, KeyType: st.keyType(), Interval: true}
+}
+
+// elements encodes the ranges as interval start and end elements; the end
+// key is the first address past the range.
+func (st Set) elements() []nftables.SetElement {
+	out := make([]nftables.SetElement, 0, 2*len(st.Ranges))
+	for _, r := range st.Ranges {
+		out = append(out, nftables.SetElement{Key: r.From.AsSlice()})
+		if next := r.To.Next(); next.IsValid() {
+			out = append(out, nftables.SetElement{Key: next.AsSlice(), IntervalEnd: true})
+		}
+	}
+	return out
+}
+
+func (st Set) script() string {
+	typ := "ipv4_addr"
+	if st.IPv6 {
+		typ = "ipv6_addr"
+	}
+	elems := make([]string, len(st.Ranges))
+	for i, r := range st.Ranges {
+		if r.From == r.To {
+			elems[i] = r.From.String()
+		} else {
+			elems[i] = r.From.String() + "-" + r.To.String()
+		}
+	}
+	var b strings.Builder
+	if st.Timeout > 0 {
+		fmt.Fprintf(&b, "\tset %s {\n\t\ttype %s; flags timeout; timeout %ds; size %d;\n\t}\n",
+			st.Name, typ, int(st.Timeout.Seconds()), st.Size)
+		return b.String()
+	}
+	fmt.Fprintf(&b, "\tset %s {\n\t\ttype %s; flags interval;\n", st.Name, typ)
+	if len(elems) > 0 {
+		fmt.Fprintf(&b, "\t\telements = { %s }\n", strings.Join(elems, ", "))
+	}
+	b.WriteString("\t}\n")
+	return b.String()
+}
+
+type Manifest struct {
+	Sets    []Set
+	Chains  []Chain
+	Sysctls []sysctl.Setting
+}
+
+// Script renders the manifest in nft -f syntax, followed by the sysctls as
+// comments.
+func (m Manifest) Script() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "table %s %s {\n", Family, Table)
+	for _, st := range m.Sets {
+		b.WriteString(st.script())
+	}
+	for _, c := range m.Chains {
+		fmt.Fprintf(&b, "\tchain %s {\n", c.Name)
+		if c.Hook != "" {
+			fmt.Fprintf(&b, "\t\ttype %s hook %s priority %d; policy accept;\n", c.Type, c.Hook, c.Priority)
+		}
+		for _, r := range c.Rules {
+			fmt.Fprintf(&b, "\t\t%s comment %q\n", r.Text, r.comment())
+		}
+		b.WriteString("\t}\n")
+	}
+	b.WriteString("}\n")
+	for _, s := range m.Sysctls {
+		fmt.Fprintf(&b, "# sysctl %s=%s\n", s.Name, s.Desired)
+	}
+	return b.String()
+}
+
+// Apply replaces the b4 table in a single netlink batch: the table is
+// added, deleted and defined again, so the kernel either commits all of it
+// or none of it.
+func (m Manifest) Apply() error {
+	c, err := nftables.New()
+	if err != nil {
+		return err
+	}
+	c.AddTable(table)
+	c.DelTable(table)
+	c.AddTable(table)
+	for _, st := range m.Sets {
+		if err := c.AddSet(st.nset(), st.elements()); err != nil {
+			return fmt.Errorf("nftables: set %s: %w", st.Name, err)
+		}
+	}
+	for _, ch := range m.Chains {
+		nc := &nftables.Chain{Name: ch.Name, Table: table}
+		if ch.Hook != "" {
+			policy := nftables.ChainPolicyAccept
+			nc.Type = nftables.ChainType(ch.Type)
+			nc.Hooknum = hooks[ch.Hook]
+			nc.Priority = nftables.ChainPriorityRef(nftables.ChainPriority(ch.Priority))
+			nc.Policy = &policy
+		}
+		c.AddChain(nc)
+		for _, r := range ch.Rules {
+			c.AddRule(&nftables.Rule{Table: table, Chain: nc, Exprs: r.Exprs, UserData: r.userData()})
+		}
+	}
+	log.Tracef("nftables:\n%s", m.Script())
+	if err := c.Flush(); err != nil {
+		return fmt.Errorf("nftables: %w", err)
+	}
+	for _, s := range m.Sysctls {
+		s.Apply()
+	}
+	return nil
+}
+
+// verify checks that the b4 table still holds every chain with the rules
+// of the manifest, in order.
+func (m Manifest) verify() error {
+	c, err := nftables.New()
+	if err != nil {
+		return err
+	}
+	if _, err := c.ListTableOfFamily(Table, nftables.TableFamilyINet); err != nil {
+		return fmt.Errorf("table %s %s missing", Family, Table)
+	}
+	for _, ch := range m.Chains {
+		rules, err := c.GetRules(table, &nftables.Chain{Name: ch.Name, Table: table})
+		if err != nil {
+			return fmt.Errorf("chain %s missing", ch.Name)
+		}
+		if err := ch.compare(rules); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// compare matches the installed rules of the chain against its manifest
+// rules by their comments.
+func (ch Chain) compare(rules []*nftables.Rule) error {
+	if len(rules) != len(ch.Rules) {
+		return fmt.Errorf("chain %s has %d rules, want %d", ch.Name, len(rules), len(ch.Rules))
+	}
+	for i, r := range ch.Rules {
+		if !bytes.Equal(rules[i].UserData, r.userData()) {
+			return fmt.Errorf("chain %s rule %d (handle %d) is not %q", ch.Name, i, rules[i].Handle, r.Text)
+		}
+	}
+	return nil
+}
+
+func (m Manifest) RemoveTable() {
+	if err := Remove(); err != nil {
+		log.Errorf("nftables: %v", err)
+	}
+}
+
+// Remove deletes the b4 table if it exists.
+func Remove() error {
+	c, err := nftables.New()
+	if err != nil {
+		return err
+	}
+	if _, err := c.ListTableOfFamily(Table, nftables.TableFamilyINet); err != nil {
+		return nil
+	}
+	c.DelTable(table)
+	if err := c.Flush(); err != nil {
+		return fmt.Errorf("delete table %s %s: %w", Family, Table, err)
+	}
+	return nil
+}
+
+func (m Manifest) RevertSysctls() {
+	for _, s := range m.Sysctls {
+		s.RevertBack()
+	}
+}
+
+// queueStmt mirrors the iptables --queue-balance/--queue-bypass target.
+func queueStmt(start, end int) Rule {
+	q := &expr.Queue{Num: uint16(start), Total: uint16(end - start + 1), Flag: expr.QueueFlagBypass}
+	if end > start {
+		q.Flag |= expr.QueueFlagFanout
+		return Rule{fmt.Sprintf("queue num %d-%d bypass,fanout", start, end), []expr.Any{q}}
+	}
+	return Rule{fmt.Sprintf("queue num %d bypass", start), []expr.Any{q}}
+}
+
+func dport(proto string, r ports.Range) Rule {
+	return port(proto, "dport", 2, r)
+}
+
+func sport(proto string, r ports.Range) Rule {
+	return port(proto, "sport", 0, r)
+}
+
+func port(proto, kw string, off uint32, r ports.Range) Rule {
+	num := byte(unix.IPPROTO_TCP)
+	if proto == "udp" {
+		num = unix.IPPROTO_UDP
+	}
+	ex := []expr.Any{
+		&expr.Meta{Key: expr.MetaKeyL4PROTO, Register: 1},
+		&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte{num}},
+		&expr.Payload{DestRegister: 1, Base: expr.PayloadBaseTransportHeader, Offset: off, Len: 2},
+	}
+	if r.Lo == r.Hi {
+		ex = append(ex, &expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: binaryutil.BigEndian.PutUint16(r.Lo)})
+		return Rule{fmt.Sprintf("%s %s %d", proto, kw, r.Lo), ex}
+	}
+	ex = append(ex, &expr.Range{Op: expr.CmpOpEq, Register: 1,
+		FromData: binaryutil.BigEndian.PutUint16(r.Lo), ToData: binaryutil.BigEndian.PutUint16(r.Hi)})
+	return Rule{fmt.Sprintf("%s %s %d-%d", proto, kw, r.Lo, r.Hi), ex}
+}
+
+func notMarked(mark uint) Rule {
+	return Rule{fmt.Sprintf("meta mark != 0x%08x", mark), []expr.Any{
+		&expr.Meta{Key: expr.MetaKeyMARK, Register: 1},
+		&expr.Cmp{Op: expr.CmpOpNeq, Register: 1, Data: binaryutil.NativeEndian.PutUint32(uint32(mark))},
+	}}
+}
+
+func ctMarked(mark uint) Rule {
+	return Rule{fmt.Sprintf("ct mark 0x%08x", mark), []expr.Any{
+		&expr.Ct{Register: 1, Key: expr.CtKeyMARK},
+		&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: binaryutil.NativeEndian.PutUint32(uint32(mark))},
+	}}
+}
+
+func ifname(key expr.MetaKey, kw, name string) Rule {
+	data := make([]byte, unix.IFNAMSIZ)
+	copy(data, name)
+	return Rule{fmt.Sprintf("%s %q", kw, name), []expr.Any{
+		&expr.Meta{Key: key, Register: 1},
+		&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: data},
+	}}
+}
+
+// ctPackets limits the rule to the first packets a connection sends in its
+// original direction. The netlink library only sends a ct direction for
+// address and port keys and its expressions cannot be extended from outside,
+// so the rule uses the xtables connbytes match, as iptables-nft does for
+// --connbytes-dir original --connbytes-mode packets.
+func ctPackets(limit int) Rule {
+	return Rule{fmt.Sprintf("ct original packets 0-%d", limit), []expr.Any{
+		&expr.Match{Name: "connbytes", Info: connbytesInfo(0, uint64(limit))},
+	}}
+}
+
+const (
+	connbytesPkts        = 0 // XT_CONNBYTES_PKTS
+	connbytesDirOriginal = 0 // XT_CONNBYTES_DIR_ORIGINAL
+	connbytesInfoLen     = 24
+)
+
+// connbytesInfo encodes struct xt_connbytes_info, padded to the 8 byte
+// alignment the kernel checks the size against.
+func connbytesInfo(from, to uint64) *xt.Unknown {
+	b := make([]byte, 0, connbytesInfoLen)
+	b = append(b, binaryutil.NativeEndian.PutUint64(from)...)
+	b = append(b, binaryutil.NativeEndian.PutUint64(to)...)
+	b = append(b, connbytesPkts, connbytesDirOriginal)
+	info := xt.Unknown(b[:connbytesInfoLen])
+	return &info
+}
+
+// daddr matches the destination address against a set of the b4 table.
+func daddr(st Set) Rule {
+	proto, off, n, kw := byte(unix.NFPROTO_IPV4), uint32(16), uint32(4), "ip"
+	if st.IPv6 {
+		proto, off, n, kw = unix.NFPROTO_IPV6, 24, 16, "ip6"
+	}
+	return Rule{fmt.Sprintf("%s daddr @%s", kw, st.Name), []expr.Any{
+		&expr.Meta{Key: expr.MetaKeyNFPROTO, Register: 1},
+		&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte{proto}},
+		&expr.Payload{DestRegister: 1, Base: expr.PayloadBaseNetworkHeader, Offset: off, Len: n},
+		&expr.Lookup{SourceRegister: 1, SetName: st.Name},
+	}}
+}
+
+const (
+	targetSet4  = "target4"
+	targetSet6  = "target6"
+	learnedSet4 = "learned4"
+	learnedSet6 = "learned6"
+)
+
+// targetSets builds the interval sets of TargetIPs, v4 then v6.
+func targetSets(prefixes []netip.Prefix) []Set {
+	ips := cidr.New(prefixes)
+	return []Set{
+		{Name: targetSet4, Ranges: ips.Ranges4()},
+		{Name: targetSet6, IPv6: true, Ranges: ips.Ranges6()},
+	}
+}
+
+func learnedSets(ttl, size int) []Set {
+	timeout := time.Duration(ttl) * time.Second
+	return []Set{
+		{Name: learnedSet4, Timeout: timeout, Size: uint32(size)},
+		{Name: learnedSet6, IPv6: true, Timeout: timeout, Size: uint32(size)},
+	}
+}
+
+func jump(chain string) Rule {
+	return Rule{"jump " + chain, []expr.Any{&expr.Verdict{Kind: expr.VerdictJump, Chain: chain}}}
+}
+
+// Plan builds the table for cfg without touching the system.
+func Plan(cfg *config.Config) Manifest {
+	return buildManifest(cfg)
+}
+
+func buildManifest(cfg *config.Config) Manifest {
+	start := cfg.QueueStartNum
+	end := cfg.QueueStartNum + cfg.Threads - 1
+	mark := notMarked(cfg.Mark)
+	queue := queueStmt(start, end)
+
+	// A queue rule is installed per address set; without sets a single
+	// empty match stands in for the address.
+	var sets []Set
+	if len(cfg.TargetIPs) > 0 {
+		sets = targetSets(cfg.TargetIPs)
+	}
+	if cfg.LearnIPs {
+		sets = append(sets, learnedSets(cfg.LearnTTL, cfg.LearnMax)...)
+	}
+	dsts := []Rule{{}}
+	if len(sets) > 0 {
+		dsts = dsts[:0]
+		for _, st := range sets {
+			dsts = append(dsts, daddr(st))
+		}
+	}
+
+	b4 := Chain{Name: "b4"}
+	output := Chain{Name: "output", Type: "route", Hook: "output", Priority: priorityMangle}
+
+	// The replies of split connections arrive on the input and forward hooks.
+	var ctChains []Chain
+	if cfg.SplitsRecords() {
+		input := Chain{Name: "input", Type: "filter", Hook: "input", Priority: priorityMangle}
+		forward := Chain{Name: "forward", Type: "filter", Hook: "forward", Priority: priorityMangle}
+		for _, r := range cfg.TCPPorts {
+			b4.Rules = append(b4.Rules, rule(dport("tcp", r), mark, ctMarked(cfg.Mark), queue))
+			input.Rules = append(input.Rules, rule(sport("tcp", r), ctMarked(cfg.Mark), queue))
+			forward.Rules = append(forward.Rules, rule(sport("tcp", r), ctMarked(cfg.Mark), queue))
+		}
+		ctChains = append(ctChains, input)
+		if !cfg.OutputOnly {
+			ctChains = append(ctChains, forward)
+		}
+	}
+	for _, r := range cfg.TCPPorts {
+		for _, dst := range dsts {
+			b4.Rules = append(b4.Rules, rule(dst, dport("tcp", r), mark, ctPackets(cfg.ConnBytesLimit), queue))
+		}
+		output.Rules = append(output.Rules, rule(dport("tcp", r), mark, jump("b4")))
+	}
+	for _, r := range cfg.UDPPorts {
+		for _, dst := range dsts {
+			b4.Rules = append(b4.Rules, rule(dst, dport("udp", r), mark, ctPackets(cfg.UDPConnBytesLimit), queue))
+		}
+		output.Rules = append(output.Rules, rule(dport("udp", r), mark, jump("b4")))
+	}
+
+	prerouting := Chain{Name: "prerouting", Type: "filter", Hook: "prerouting", Priority: priorityMangle}
+	postrouting := Chain{Name: "postrouting", Type: "filter", Hook: "postrouting", Priority: priorityMangle}
+	if !cfg.OutputOnly {
+		for _, name := range cfg.LANIfaces {
+			prerouting.Rules = append(prerouting.Rules, rule(ifname(expr.MetaKeyIIFNAME, "iifname", name), mark, jump("b4")))
+		}
+		for _, name := range cfg.WANIfaces {
+			postrouting.Rules = append(postrouting.Rules, rule(ifname(expr.MetaKeyOIFNAME, "oifname", name), mark, jump("b4")))
+		}
+	}
+
+	chains := append([]Chain{b4, prerouting, postrouting, output}, ctChains...)
+	return Manifest{Sets: sets, Chains: chains, Sysctls: sysctl.Conntrack}
+}
+
+func AddRules(cfg *config.Config) error {
+	if cfg.SkipIpTables {
+		return nil
+	}
+	log.Infof("NFTABLES: adding rules")
+	m := buildManifest(cfg)
+	return m.Apply()
+}
+
+// Verify reports whether the b4 table is still installed as built from cfg.
+func Verify(cfg *config.Config) error {
+	return buildManifest(cfg).verify()
+}
+
+// Learn adds a server address to the learned set of its family. An address
+// that is already there keeps its remaining timeout.
+func Learn(addr netip.Addr, ttl time.Duration) error {
+	c, err := nftables.New()
+	if err != nil {
+		return err
+	}
+	st := Set{Name: learnedSet4, Timeout: ttl}
+	if !addr.Is4() {
+		st = Set{Name: learnedSet6, IPv6: true, Timeout: ttl}
+	}
+	if err := c.SetAddElements(st.nset(), []nftables.SetElement{{Key: addr.AsSlice(), Timeout: ttl}}); err != nil {
+		return err
+	}
+	if err := c.Flush(); err != nil {
+		return fmt.Errorf("nftables: learn %s: %w", addr, err)
+	}
+	return nil
+}
+
+// LoadTargets replaces the contents of the target sets after a reload, in
+// one batch so lookups never see them half loaded.
+func LoadTargets(cfg *config.Config) error {
+	if cfg.SkipIpTables || len(cfg.TargetIPs) == 0 {
+		return nil
+	}
+	c, err := nftables.New()
+	if err != nil {
+		return err
+	}
+	for _, st := range targetSets(cfg.TargetIPs) {
+		ns := st.nset()
+		c.FlushSet(ns)
+		if err := c.SetAddElements(ns, st.elements()); err != nil {
+			return fmt.Errorf("nftables: set %s: %w", st.Name, err)
+		}
+	}
+	if err := c.Flush(); err != nil {
+		return fmt.Errorf("nftables: %w", err)
+	}
+	return nil
+}
+
+func ClearRules(cfg *config.Config) error {
+	if cfg.SkipIpTables {
+		return nil
+	}
+	m := buildManifest(cfg)
+	m.RemoveTable()
+	m.RevertSysctls()
+	return nil
+}
@@ -0,0 +1,94 @@
+package nftables
+
+import (
+	"encoding/binary"
+	"strings"
+	"testing"
+
+	"github.com/daniellavrushin/b4/config"
+	"github.com/daniellavrushin/b4/ports"
+	"github.com/google/nftables"
+	"github.com/google/nftables/expr"
+	"github.com/google/nftables/xt"
+)
+
+func TestCtPackets(t *testing.T) {
+	r := ctPackets(19)
+	if len(r.Exprs) != 1 {
+		t.Fatalf("%d expressions", len(r.Exprs))
+	}
+	m, ok := r.Exprs[0].(*expr.Match)
+	if !ok || m.Name != "connbytes" || m.Rev != 0 {
+		t.Fatalf("expression %#v", r.Exprs[0])
+	}
+	info := []byte(*m.Info.(*xt.Unknown))
+	if len(info) != 24 {
+		t.Fatalf("info is %d bytes, want 24", len(info))
+	}
+	from, to := binary.NativeEndian.Uint64(info), binary.NativeEndian.Uint64(info[8:])
+	if from != 0 || to != 19 || info[16] != connbytesPkts || info[17] != connbytesDirOriginal {
+		t.Errorf("info % x", info)
+	}
+	if r.Text != "ct original packets 0-19" {
+		t.Errorf("text %q", r.Text)
+	}
+}
+
+func installed(ch Chain) []*nftables.Rule {
+	var out []*nftables.Rule
+	for i, r := range ch.Rules {
+		out = append(out, &nftables.Rule{Handle: uint64(i + 1), Exprs: r.Exprs, UserData: r.userData()})
+	}
+	return out
+}
+
+func TestChainCompare(t *testing.T) {
+	cfg := config.DefaultConfig
+	cfg.UDPConnBytesLimit = 8
+	b4 := buildManifest(&cfg).Chains[0]
+	if b4.Name != "b4" || len(b4.Rules) != 2 {
+		t.Fatalf("chain %s with %d rules", b4.Name, len(b4.Rules))
+	}
+
+	if err := b4.compare(installed(b4)); err != nil {
+		t.Errorf("same rules: %v", err)
+	}
+
+	changed := cfg
+	changed.ConnBytesLimit++
+	if err := b4.compare(installed(buildManifest(&changed).Chains[0])); err == nil {
+		t.Error("rule with another packet limit accepted")
+	}
+
+	swapped := installed(b4)
+	swapped[0], swapped[1] = swapped[1], swapped[0]
+	if err := b4.compare(swapped); err == nil {
+		t.Error("reordered rules accepted")
+	}
+
+	foreign := installed(b4)
+	foreign[1].UserData = nil
+	if err := b4.compare(foreign); err == nil || !strings.Contains(err.Error(), "handle 2") {
+		t.Errorf("rule without comment: %v", err)
+	}
+
+	if err := b4.compare(installed(b4)[:1]); err == nil {
+		t.Error("missing rule accepted")
+	}
+}
+
+func TestRuleUserData(t *testing.T) {
+	https := ports.Range{Lo: 443, Hi: 443}
+	r := rule(dport("tcp", https), ctPackets(19))
+	ud := r.userData()
+	c := r.comment()
+	if !strings.HasPrefix(c, "b4:") || len(c) != 3+16 {
+		t.Fatalf("comment %q", c)
+	}
+	if ud[0] != udataRuleComment || int(ud[1]) != len(c)+1 || string(ud[2:len(ud)-1]) != c || ud[len(ud)-1] != 0 {
+		t.Errorf("user data % x", ud)
+	}
+	if rule(dport("tcp", https), ctPackets(20)).comment() == c {
+		t.Error("different rules share a comment")
+	}
+}
@@ -0,0 +1,135 @@
+// Package ports implements the destination port sets that select which TCP
+// and UDP traffic b4 queues and inspects.
+package ports
+
+import (
+	"encoding/json"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// Range is an inclusive port range; single ports have Lo == Hi.
+type Range struct {
+	Lo, Hi uint16
+}
+
+// Set is a list of port ranges written as "443,2053,50000-65535".
+type Set []Range
+
+// Parse reads a comma-separated list of ports and lo-hi ranges. The
+// iptables lo:hi form is accepted as well; repeated entries are kept once.
+func Parse(s string) (Set, error) {
+	var out Set
+	for _, f := range strings.Split(s, ",") {
+		f = strings.TrimSpace(f)
+		if f == "" {
+			continue
+		}
+		lo, hi, isRange := strings.Cut(strings.ReplaceAll(f, ":", "-"), "-")
+		a, err := parsePort(lo)
+		if err != nil {
+			return nil, err
+		}
+		b := a
+		if isRange {
+			if b, err = parsePort(hi); err != nil {
+				return nil, err
+			}
+			if b < a {
+				return nil, fmt.Errorf("port range %q is reversed", f)
+			}
+		}
+		if !slices.Contains(out, Range{a, b}) {
+			out = append(out, Range{a, b})
+		}
+	}
+	if len(out) == 0 {
+		return nil, fmt.Errorf("empty port set %q", s)
+	}
+	return out, nil
+}
+
+func parsePort(s string) (uint16, error) {
+	n, err := strconv.ParseUint(strings.TrimSpace(s), 10, 16)
+	if err != nil || n == 0 {
+		return 0, fmt.Errorf("invalid port %q", s)
+	}
+	return uint16(n), nil
+}
+
+func (s Set) Contains(p uint16) bool {
+	for _, r := range s {
+		if p >= r.Lo && p <= r.Hi {
+			return true
+		}
+	}
+	return false
+}
+
+// Single reports whether the set is exactly one port.
+func (s Set) Single() bool {
+	return len(s) == 1 && s[0].Lo == s[0].Hi
+}
+
+// Slots is the number of iptables multiport slots the set uses; a range
+// takes two and the match accepts at most 15.
+func (s Set) Slots() int {
+	n := 0
+	for _, r := range s {
+		if r.Lo == r.Hi {
+			n++
+		} else {
+			n += 2
+		}
+	}
+	return n
+}
+
+func (s Set) join(sep, rangeSep string) string {
+	parts := make([]string, len(s))
+	for i, r := range s {
+		parts[i] = strconv.Itoa(int(r.Lo))
+		if r.Hi != r.Lo {
+			parts[i] += rangeSep + strconv.Itoa(int(r.Hi))
+		}
+	}
+	return strings.Join(parts, sep)
+}
+
+func (s Set) String() string {
+	return s.join(",", "-")
+}
+
+// Multiport renders the set for iptables --dport/--dports.
+func (s Set) Multiport() string {
+	return s.join(",", ":")
+}
+
+// Set implements flag.Value.
+func (s *Set) Set(v string) error {
+	p, err := Parse(v)
+	if err != nil {
+		return err
+	}
+	*s = p
+	return nil
+}
+
+func (s Set) MarshalJSON() ([]byte, error) {
+	return json.Marshal(s.String())
+}
+
+// UnmarshalJSON accepts "443,8443" as well as a bare number.
+func (s *Set) UnmarshalJSON(b []byte) error {
+	var v string
+	if err := json.Unmarshal(b, &v); err != nil {
+		var n json.Number
+		if json.Unmarshal(b, &n) != nil {
+			return err
+		}
+		v = n.String()
+	}
+	return s.Set(v)
+}
@@ -0,0 +1,73 @@
+package ports
+
+import (
+	"encoding/json"
+	"slices"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		in    string
+		want  Set
+		slots int
+		err   bool
+	}{
+		{in: "443", want: Set{{443, 443}}, slots: 1},
+		{in: "443, 2053,8443", want: Set{{443, 443}, {2053, 2053}, {8443, 8443}}, slots: 3},
+		{in: "50000-65535", want: Set{{50000, 65535}}, slots: 2},
+		{in: "1000:2000", want: Set{{1000, 2000}}, slots: 2},
+		{in: "443,80-81", want: Set{{443, 443}, {80, 81}}, slots: 3},
+		{in: "7-7", want: Set{{7, 7}}, slots: 1},
+		{in: "443,443,80-90,80:90", want: Set{{443, 443}, {80, 90}}, slots: 3},
+		{in: "443,,", want: Set{{443, 443}}, slots: 1},
+		{in: "", err: true},
+		{in: " , ", err: true},
+		{in: "0", err: true},
+		{in: "65536", err: true},
+		{in: "-1", err: true},
+		{in: "2000-1000", err: true},
+		{in: "1-65536", err: true},
+		{in: "https", err: true},
+		{in: "1-2-3", err: true},
+	}
+	for _, tt := range tests {
+		got, err := Parse(tt.in)
+		if (err != nil) != tt.err {
+			t.Errorf("Parse(%q) error = %v, want error %t", tt.in, err, tt.err)
+			continue
+		}
+		if tt.err {
+			continue
+		}
+		if !slices.Equal(got, tt.want) || got.Slots() != tt.slots {
+			t.Errorf("Parse(%q) = %v with %d slots, want %v with %d", tt.in, got, got.Slots(), tt.want, tt.slots)
+		}
+	}
+}
+
+func TestSetFormats(t *testing.T) {
+	s, err := Parse("443,50000-65535")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.String() != "443,50000-65535" || s.Multiport() != "443,50000:65535" {
+		t.Errorf("String %q, Multiport %q", s.String(), s.Multiport())
+	}
+	for _, p := range []struct {
+		port uint16
+		in   bool
+	}{{443, true}, {444, false}, {50000, true}, {65535, true}, {49999, false}} {
+		if s.Contains(p.port) != p.in {
+			t.Errorf("Contains(%d) = %t", p.port, !p.in)
+		}
+	}
+	var back Set
+	b, _ := json.Marshal(s)
+	if err := json.Unmarshal(b, &back); err != nil || !slices.Equal(back, s) {
+		t.Errorf("JSON round trip %s: %v, %v", b, back, err)
+	}
+	if err := json.Unmarshal([]byte("8443"), &back); err != nil || !back.Single() || back[0].Lo != 8443 {
+		t.Errorf("bare number: %v, %v", back, err)
+	}
+}
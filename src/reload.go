@@ -0,0 +1,154 @@
+package main
+
+import (
+	"os"
+	"slices"
+	"sync/atomic"
+	"time"
+
+	"github.com/daniellavrushin/b4/config"
+	"github.com/daniellavrushin/b4/log"
+	"github.com/daniellavrushin/b4/sni"
+)
+
+// reloadConfig re-reads the config file and domain lists using the original
+// command line. Settings bound at startup (queues, mark, firewall,
+// interfaces) are carried over from cur; changing them needs a restart.
+func reloadConfig(args []string, cur *config.Config) (*config.Config, error) {
+	next := config.DefaultConfig
+	if _, err := next.ParseArgs(args); err != nil {
+		return nil, err
+	}
+	resolveFirewall(&next)
+	if next.QueueStartNum != cur.QueueStartNum || next.Threads != cur.Threads ||
+		next.Mark != cur.Mark || next.ConnBytesLimit != cur.ConnBytesLimit ||
+		next.UDPConnBytesLimit != cur.UDPConnBytesLimit ||
+		!slices.Equal(next.TCPPorts, cur.TCPPorts) || !slices.Equal(next.UDPPorts, cur.UDPPorts) ||
+		next.Interface != cur.Interface || next.SkipIpTables != cur.SkipIpTables ||
+		next.Firewall != cur.Firewall || next.OutputOnly != cur.OutputOnly ||
+		!slices.Equal(next.LANIfaces, cur.LANIfaces) || !slices.Equal(next.WANIfaces, cur.WANIfaces) ||
+		next.UseGSO != cur.UseGSO || next.UseConntrack != cur.UseConntrack ||
+		next.WatchdogInterval != cur.WatchdogInterval || next.StateDir != cur.StateDir ||
+		next.LearnIPs != cur.LearnIPs || next.LearnTTL != cur.LearnTTL || next.LearnMax != cur.LearnMax {
+		log.Errorf("reload: queue, mark, firewall and interface settings changed; restart b4 to apply them")
+	}
+	next.QueueStartNum = cur.QueueStartNum
+	next.Threads = cur.Threads
+	next.Mark = cur.Mark
+	next.ConnBytesLimit = cur.ConnBytesLimit
+	next.UDPConnBytesLimit = cur.UDPConnBytesLimit
+	next.TCPPorts = cur.TCPPorts
+	next.UDPPorts = cur.UDPPorts
+	next.Interface = cur.Interface
+	next.SkipIpTables = cur.SkipIpTables
+	next.Firewall = cur.Firewall
+	next.LANIfaces = cur.LANIfaces
+	next.WANIfaces = cur.WANIfaces
+	next.OutputOnly = cur.OutputOnly
+	next.UseGSO = cur.UseGSO
+	next.UseConntrack = cur.UseConntrack
+	next.WatchdogInterval = cur.WatchdogInterval
+	next.StateDir = cur.StateDir
+	next.LearnIPs = cur.LearnIPs
+	next.LearnTTL = cur.LearnTTL
+	next.LearnMax = cur.LearnMax
+	// Split TLS records need the conntrack rules, which are installed with
+	// the other firewall rules at startup.
+	if next.SplitsRecords() && !cur.SplitsRecords() {
+		log.Errorf("reload: TLS record splitting enabled; restart b4 to apply it")
+		next.Strategy.TLSRecSNI, next.Strategy.TLSRecPos = false, 0
+		for i := range next.Profiles {
+			next.Profiles[i].Strategy.TLSRecSNI, next.Profiles[i].Strategy.TLSRecPos = false, 0
+		}
+	}
+	// The target sets can be refilled in place, but whether the queue rules
+	// match them at all is decided when they are installed.
+	if (len(next.TargetIPs) == 0) != (len(cur.TargetIPs) == 0) {
+		log.Errorf("reload: target IPs added or removed entirely; restart b4 to apply them")
+		next.TargetIPs = cur.TargetIPs
+	} else if err := loadTargets(&next); err != nil {
+		return nil, err
+	}
+	return &next, nil
+}
+
+func newMatcher(cfg *config.Config) *sni.Matcher {
+	domains := cfg.AllSNIDomains()
+	if len(domains) == 0 {
+		return nil
+	}
+	m := sni.NewMatcher()
+	if err := m.Add(domains, 0); err != nil {
+		log.Errorf("sniffer matcher: %v", err)
+	}
+	return m
+}
+
+// fileWatcher polls the mtimes of the files the config was built from and
+// signals on changed when any of them differs from the last poll.
+type fileWatcher struct {
+	files atomic.Pointer[[]string]
+	stop  chan struct{}
+}
+
+func newFileWatcher(files []string) *fileWatcher {
+	w := &fileWatcher{stop: make(chan struct{})}
+	w.SetFiles(files)
+	return w
+}
+
+func (w *fileWatcher) SetFiles(files []string) {
+	w.files.Store(&files)
+}
+
+func (w *fileWatcher) Run(every time.Duration, changed chan<- struct{}) {
+	last := w.snapshot()
+	t := time.NewTicker(every)
+	go func() {
+		defer t.Stop()
+		for {
+			select {
+			case <-w.stop:
+				return
+			case <-t.C:
+			}
+			cur := w.snapshot()
+			if !sameMtimes(last, cur) {
+				select {
+				case changed <- struct{}{}:
+				default:
+				}
+			}
+			last = cur
+		}
+	}()
+}
+
+func (w *fileWatcher) Close() {
+	close(w.stop)
+}
+
+func (w *fileWatcher) snapshot() map[string]time.Time {
+	files := *w.files.Load()
+	m := make(map[string]time.Time, len(files))
+	for _, f := range files {
+		if st, err := os.Stat(f); err == nil {
+			m[f] = st.ModTime()
+		} else {
+			m[f] = time.Time{}
+		}
+	}
+	return m
+}
+
+func sameMtimes(a, b map[string]time.Time) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for k, v := range a {
+		if w, ok := b[k]; !ok || !w.Equal(v) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/daniellavrushin/b4/config"
+	"github.com/daniellavrushin/b4/iptables"
+	"github.com/daniellavrushin/b4/log"
+	"github.com/daniellavrushin/b4/nftables"
+	"github.com/daniellavrushin/b4/state"
+	"github.com/daniellavrushin/b4/sysctl"
+)
+
+const rulesUsage = "usage: b4 rules print|apply|clear [flags]"
+
+// runRules implements `b4 rules`, which manages the firewall rules without
+// running the packet processor: print shows what would be installed for the
+// given flags, apply installs it and clear removes it. A daemon started with
+// --skip-iptables can then rely on rules installed this way.
+func runRules(args []string) int {
+	if len(args) < 1 || (args[0] != "print" && args[0] != "apply" && args[0] != "clear") {
+		fmt.Fprintln(os.Stderr, rulesUsage)
+		return 2
+	}
+	cmd := args[0]
+	cfg := config.DefaultConfig
+	log.Init(os.Stderr, log.Level(cfg.Logging.Level), true)
+	if _, err := cfg.ParseArgs(args[1:]); err != nil {
+		log.Flush()
+		return 1
+	}
+	cfg.SkipIpTables = false
+	resolveFirewall(&cfg)
+	sysctl.SnapshotPath = state.SysctlSnapshot(cfg.StateDir)
+
+	switch cmd {
+	case "print":
+		if cfg.Firewall == config.FirewallNFT {
+			fmt.Print(nftables.Plan(&cfg).Script())
+		} else {
+			fmt.Print(iptables.Plan(&cfg).Script())
+		}
+	case "apply":
+		if err := os.MkdirAll(cfg.StateDir, 0700); err != nil {
+			log.Errorf("rules: %v", err)
+			return 1
+		}
+		if err := addRules(&cfg); err != nil {
+			log.Errorf("rules: apply: %v", err)
+			return 1
+		}
+		log.Infof("rules: %s rules applied", cfg.Firewall)
+	case "clear":
+		if err := clearRules(&cfg); err != nil {
+			log.Errorf("rules: clear: %v", err)
+			return 1
+		}
+		log.Infof("rules: %s rules cleared", cfg.Firewall)
+	}
+	return 0
+}
@@ -1,42 +1,135 @@
 package sni
 
 import (
+	"fmt"
+	"regexp"
 	"strings"
 )
 
-type SuffixSet struct {
-	m map[string]struct{}
+// Rule kinds understood by Matcher, using the v2ray domain list prefixes.
+// An entry without a prefix is a domain (suffix) rule.
+const (
+	KindDomain  = "domain"
+	KindFull    = "full"
+	KindKeyword = "keyword"
+	KindRegexp  = "regexp"
+)
+
+// SplitRule returns the kind and value of a domain list entry.
+func SplitRule(entry string) (kind, value string) {
+	entry = strings.TrimSpace(entry)
+	if i := strings.IndexByte(entry, ':'); i > 0 {
+		switch k := strings.ToLower(entry[:i]); k {
+		case KindDomain, KindFull, KindKeyword, KindRegexp:
+			return k, strings.TrimSpace(entry[i+1:])
+		}
+	}
+	return KindDomain, entry
+}
+
+type taggedRegexp struct {
+	re  *regexp.Regexp
+	tag int
+}
+
+type taggedKeyword struct {
+	kw  string
+	tag int
+}
+
+// Matcher matches hosts against full, domain (suffix), keyword (substring)
+// and regexp (RE2) rules, each carrying an integer tag. Precedence is full,
+// then the longest domain suffix, then keywords and regexps in the order
+// they were added. A rule added twice keeps the tag it was first added with.
+type Matcher struct {
+	full     map[string]int
+	suffix   map[string]int
+	keywords []taggedKeyword
+	regexps  []taggedRegexp
 }
 
-func NewSuffixSet(domains []string) *SuffixSet {
-	m := make(map[string]struct{}, len(domains))
-	for _, d := range domains {
-		d = strings.ToLower(strings.TrimSpace(d))
-		if d == "" {
+func NewMatcher() *Matcher {
+	return &Matcher{full: make(map[string]int), suffix: make(map[string]int)}
+}
+
+// Add loads entries with the given tag. Invalid regexps are skipped and
+// reported in the returned error.
+func (m *Matcher) Add(entries []string, tag int) error {
+	var bad []string
+	for _, e := range entries {
+		kind, v := SplitRule(e)
+		if v == "" {
 			continue
 		}
-		if strings.HasSuffix(d, ".") {
-			d = strings.TrimRight(d, ".")
+		switch kind {
+		case KindRegexp:
+			re, err := regexp.Compile(v)
+			if err != nil {
+				bad = append(bad, v)
+				continue
+			}
+			m.regexps = append(m.regexps, taggedRegexp{re: re, tag: tag})
+		case KindKeyword:
+			m.keywords = append(m.keywords, taggedKeyword{kw: strings.ToLower(v), tag: tag})
+		case KindFull:
+			addFirst(m.full, normalizeDomain(v), tag)
+		default:
+			if d := normalizeDomain(v); d != "" {
+				addFirst(m.suffix, d, tag)
+			}
 		}
-		m[d] = struct{}{}
 	}
-	return &SuffixSet{m: m}
+	if len(bad) > 0 {
+		return fmt.Errorf("invalid regexp rules: %q", bad)
+	}
+	return nil
+}
+
+func addFirst(m map[string]int, key string, tag int) {
+	if _, ok := m[key]; !ok {
+		m[key] = tag
+	}
 }
 
-func (s *SuffixSet) Match(host string) bool {
-	host = strings.ToLower(host)
+func normalizeDomain(d string) string {
+	d = strings.ToLower(strings.TrimSpace(d))
+	d = strings.TrimPrefix(d, "*.")
+	d = strings.TrimPrefix(d, ".")
+	return strings.TrimRight(d, ".")
+}
+
+func (m *Matcher) Match(host string) bool {
+	_, ok := m.Lookup(host)
+	return ok
+}
+
+func (m *Matcher) Lookup(host string) (int, bool) {
+	host = strings.TrimRight(strings.ToLower(host), ".")
 	if host == "" {
-		return false
+		return 0, false
+	}
+	if t, ok := m.full[host]; ok {
+		return t, true
 	}
-	if _, ok := s.m[host]; ok {
-		return true
+	if t, ok := m.suffix[host]; ok {
+		return t, true
 	}
 	for i := 0; i < len(host); i++ {
 		if host[i] == '.' {
-			if _, ok := s.m[host[i+1:]]; ok {
-				return true
+			if t, ok := m.suffix[host[i+1:]]; ok {
+				return t, true
 			}
 		}
 	}
-	return false
+	for _, k := range m.keywords {
+		if strings.Contains(host, k.kw) {
+			return k.tag, true
+		}
+	}
+	for _, r := range m.regexps {
+		if r.re.MatchString(host) {
+			return r.tag, true
+		}
+	}
+	return 0, false
 }
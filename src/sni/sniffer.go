@@ -6,10 +6,13 @@ import (
 	"encoding/binary"
 	"errors"
 	"net"
+	"net/netip"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/daniellavrushin/b4/log"
+	"github.com/daniellavrushin/b4/ports"
 	"golang.org/x/sys/unix"
 )
 
@@ -21,15 +24,31 @@ type FiveTuple struct {
 	DstPort uint16
 }
 
+// Dst returns the destination address; IPv4 is stored in the last four bytes.
+func (k FiveTuple) Dst() netip.Addr {
+	if k.V6 {
+		return netip.AddrFrom16(k.DstIP)
+	}
+	return netip.AddrFrom4([4]byte(k.DstIP[12:]))
+}
+
 type Config struct {
 	Iface               string
 	SnapLen             int
 	FlowTTL             time.Duration
 	MaxClientHelloBytes int
 	Promisc             bool
-	Matcher             *SuffixSet
-	OnTLSHost           func(FiveTuple, string)
-	OnQUICHost          func(FiveTuple, string)
+	Matcher             *Matcher
+	TCPPorts            ports.Set
+	UDPPorts            ports.Set
+	// TCPPackets stops inspecting a flow after this many client packets,
+	// like the connbytes window of the queue rules.
+	TCPPackets int
+	OnTLSHost  func(FiveTuple, string)
+	OnQUICHost func(FiveTuple, string)
+	// OnSynAck receives the source and IP TTL (hop limit) of every SYN-ACK
+	// from one of TCPPorts, from which the server's distance is derived.
+	OnSynAck func(netip.Addr, uint8)
 }
 
 type Sniffer struct {
@@ -42,12 +61,14 @@ type Sniffer struct {
 	stop       chan struct{}
 	wg         sync.WaitGroup
 	promiscSet bool
+	matcher    atomic.Pointer[Matcher]
 }
 
 type flow struct {
 	baseSeq uint32
 	nextSeq uint32
 	buf     []byte
+	pkts    int
 	last    time.Time
 }
 
@@ -61,6 +82,15 @@ func NewSniffer(cfg Config) (*Sniffer, error) {
 	if cfg.MaxClientHelloBytes <= 0 {
 		cfg.MaxClientHelloBytes = 8192
 	}
+	if len(cfg.TCPPorts) == 0 {
+		cfg.TCPPorts = ports.Set{{Lo: 443, Hi: 443}}
+	}
+	if len(cfg.UDPPorts) == 0 {
+		cfg.UDPPorts = ports.Set{{Lo: 443, Hi: 443}}
+	}
+	if cfg.TCPPackets <= 0 {
+		cfg.TCPPackets = 19
+	}
 	ifi, err := net.InterfaceByName(cfg.Iface)
 	if err != nil {
 		return nil, err
@@ -97,9 +127,15 @@ func NewSniffer(cfg Config) (*Sniffer, error) {
 		stop:       make(chan struct{}),
 		promiscSet: prom,
 	}
+	s.matcher.Store(cfg.Matcher)
 	return s, nil
 }
 
+// SetMatcher replaces the target domain set while the sniffer is running.
+func (s *Sniffer) SetMatcher(m *Matcher) {
+	s.matcher.Store(m)
+}
+
 func (s *Sniffer) Run() {
 	s.wg.Add(2)
 	go s.rxLoop()
@@ -199,7 +235,7 @@ func (s *Sniffer) handleIPv4(ip []byte) {
 	pl := ip[ihl:total]
 	switch proto {
 	case 6:
-		s.handleTCP(false, src, dst, pl)
+		s.handleTCP(false, src, dst, ip[8], pl)
 	case 17:
 		s.handleUDP(false, src, dst, pl)
 	}
@@ -232,7 +268,7 @@ func (s *Sniffer) handleIPv6(ip6 []byte) {
 	}
 	switch nxt {
 	case 6:
-		s.handleTCP(true, src, dst, payload)
+		s.handleTCP(true, src, dst, ip6[7], payload)
 	case 17:
 		s.handleUDP(true, src, dst, payload)
 	}
@@ -243,14 +279,14 @@ func (s *Sniffer) handleUDP(v6 bool, src, dst, udp []byte) {
 		return
 	}
 	dport := binary.BigEndian.Uint16(udp[2:4])
-	if dport != 443 {
+	if !s.cfg.UDPPorts.Contains(dport) {
 		return
 	}
 	payload := udp[8:]
 	if len(payload) == 0 {
 		return
 	}
-	log.Tracef("UDP:443 seen v6=%v len=%d", v6, len(payload))
+	log.Tracef("UDP:%d seen v6=%v len=%d", dport, v6, len(payload))
 	var key FiveTuple
 	fillKey(&key, v6, src, dst, binary.BigEndian.Uint16(udp[0:2]), dport)
 	host, ok := ParseQUICClientHelloSNI(payload)
@@ -258,7 +294,7 @@ func (s *Sniffer) handleUDP(v6 bool, src, dst, udp []byte) {
 	if !ok || host == "" {
 		return
 	}
-	if s.cfg.Matcher != nil && !s.cfg.Matcher.Match(host) {
+	if m := s.matcher.Load(); m != nil && !m.Match(host) {
 		return
 	}
 	log.Infof("Target SNI detected (QUIC): %s", host)
@@ -267,7 +303,7 @@ func (s *Sniffer) handleUDP(v6 bool, src, dst, udp []byte) {
 	}
 }
 
-func (s *Sniffer) handleTCP(v6 bool, src, dst, tcp []byte) {
+func (s *Sniffer) handleTCP(v6 bool, src, dst []byte, ttl uint8, tcp []byte) {
 	if len(tcp) < 20 {
 		return
 	}
@@ -278,12 +314,19 @@ func (s *Sniffer) handleTCP(v6 bool, src, dst, tcp []byte) {
 	flags := tcp[13]
 	sport := binary.BigEndian.Uint16(tcp[0:2])
 	dport := binary.BigEndian.Uint16(tcp[2:4])
-	if dport != 443 {
+	if flags&0x12 == 0x12 {
+		if s.cfg.OnSynAck != nil && s.cfg.TCPPorts.Contains(sport) {
+			addr, _ := netip.AddrFromSlice(src)
+			s.cfg.OnSynAck(addr, ttl)
+		}
+		return
+	}
+	if !s.cfg.TCPPorts.Contains(dport) {
 		return
 	}
 	seq := binary.BigEndian.Uint32(tcp[4:8])
 	payload := tcp[dataOff:]
-	log.Tracef("TCP:443 seen v6=%v flags=0x%02x seq=%d len=%d", v6, flags, seq, len(payload))
+	log.Tracef("TCP:%d seen v6=%v flags=0x%02x seq=%d len=%d", dport, v6, flags, seq, len(payload))
 	var key FiveTuple
 	fillKey(&key, v6, src, dst, sport, dport)
 	now := time.Now()
@@ -297,6 +340,14 @@ func (s *Sniffer) handleTCP(v6 bool, src, dst, tcp []byte) {
 		f.baseSeq = seq
 		f.nextSeq = seq + 1
 		f.buf = f.buf[:0]
+		f.pkts = 0
+	}
+	f.pkts++
+	if f.pkts > s.cfg.TCPPackets {
+		f.buf = nil
+		f.last = now
+		s.mu.Unlock()
+		return
 	}
 	if len(payload) > 0 {
 		if f.nextSeq == 0 {
@@ -320,7 +371,7 @@ func (s *Sniffer) handleTCP(v6 bool, src, dst, tcp []byte) {
 			host, ok := ParseTLSClientHelloSNI(f.buf)
 			log.Tracef("TLS SNI parse: %v, host=%q", ok, host)
 			if ok && host != "" {
-				if s.cfg.Matcher != nil && !s.cfg.Matcher.Match(host) {
+				if m := s.matcher.Load(); m != nil && !m.Match(host) {
 					delete(s.flows, key)
 					s.mu.Unlock()
 					return
@@ -0,0 +1,121 @@
+// Package state keeps a journal of what b4 changed on the system, so a run
+// that was killed before it could clean up can be reverted later.
+package state
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/daniellavrushin/b4/iptables"
+	"github.com/daniellavrushin/b4/sysctl"
+)
+
+const journalFile = "journal.json"
+
+// Journal records everything a running b4 installed.
+type Journal struct {
+	PID           int                `json:"pid"`
+	BootID        string             `json:"boot_id,omitempty"`
+	StartTicks    uint64             `json:"start_ticks,omitempty"`
+	Started       time.Time          `json:"started"`
+	Firewall      string             `json:"firewall,omitempty"`
+	QueueStartNum int                `json:"queue_start_num"`
+	Threads       int                `json:"threads"`
+	Mark          uint               `json:"mark"`
+	IPTables      *iptables.Manifest `json:"iptables,omitempty"`
+	NFTTable      string             `json:"nft_table,omitempty"`
+	Sysctls       []sysctl.Setting   `json:"sysctls,omitempty"`
+}
+
+// SysctlSnapshot is the file the sysctl package keeps original values in.
+func SysctlSnapshot(dir string) string {
+	return filepath.Join(dir, "sysctl.json")
+}
+
+// Load reads the journal from dir. It returns os.ErrNotExist when there is
+// none, i.e. the last run shut down cleanly.
+func Load(dir string) (*Journal, error) {
+	b, err := os.ReadFile(filepath.Join(dir, journalFile))
+	if err != nil {
+		return nil, err
+	}
+	var j Journal
+	if err := json.Unmarshal(b, &j); err != nil {
+		return nil, err
+	}
+	return &j, nil
+}
+
+// Save writes the journal atomically, creating dir if needed.
+func (j *Journal) Save(dir string) error {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	b, err := json.MarshalIndent(j, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := filepath.Join(dir, journalFile+".tmp")
+	if err := os.WriteFile(tmp, b, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, filepath.Join(dir, journalFile))
+}
+
+// Alive reports whether the process that wrote the journal still runs. A
+// process that merely reuses its PID, after a reboot or a long uptime, has
+// another boot ID or start time.
+func (j *Journal) Alive() bool {
+	if j.PID <= 0 || j.PID == os.Getpid() {
+		return false
+	}
+	if err := syscall.Kill(j.PID, 0); err != nil && !errors.Is(err, syscall.EPERM) {
+		return false
+	}
+	if j.BootID == "" {
+		return true // written before the identity was recorded
+	}
+	return j.BootID == BootID() && j.StartTicks == StartTicks(j.PID)
+}
+
+// BootID returns the kernel's random ID of the current boot.
+func BootID() string {
+	b, err := os.ReadFile("/proc/sys/kernel/random/boot_id")
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(b))
+}
+
+// StartTicks returns the start time of process pid in clock ticks since
+// boot, or 0 when it cannot be read.
+func StartTicks(pid int) uint64 {
+	b, err := os.ReadFile("/proc/" + strconv.Itoa(pid) + "/stat")
+	if err != nil {
+		return 0
+	}
+	// The command name is parenthesized and may hold spaces; starttime is
+	// the 22nd field, the 20th after it.
+	s := string(b)
+	f := strings.Fields(s[strings.LastIndexByte(s, ')')+1:])
+	if len(f) < 20 {
+		return 0
+	}
+	n, _ := strconv.ParseUint(f[19], 10, 64)
+	return n
+}
+
+// Remove deletes the journal after its changes were reverted.
+func Remove(dir string) error {
+	err := os.Remove(filepath.Join(dir, journalFile))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	return err
+}
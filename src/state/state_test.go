@@ -0,0 +1,31 @@
+package state
+
+import (
+	"os"
+	"testing"
+)
+
+func TestAlive(t *testing.T) {
+	ppid := os.Getppid()
+	if StartTicks(ppid) == 0 || BootID() == "" {
+		t.Skip("no /proc")
+	}
+	live := Journal{PID: ppid, BootID: BootID(), StartTicks: StartTicks(ppid)}
+	tests := []struct {
+		name string
+		j    Journal
+		want bool
+	}{
+		{"running", live, true},
+		{"older journal without identity", Journal{PID: ppid}, true},
+		{"PID reused", Journal{PID: ppid, BootID: live.BootID, StartTicks: live.StartTicks + 1}, false},
+		{"other boot", Journal{PID: ppid, BootID: "00000000-0000-0000-0000-000000000000", StartTicks: live.StartTicks}, false},
+		{"this process", Journal{PID: os.Getpid(), BootID: live.BootID, StartTicks: StartTicks(os.Getpid())}, false},
+		{"no PID", Journal{}, false},
+	}
+	for _, tt := range tests {
+		if got := tt.j.Alive(); got != tt.want {
+			t.Errorf("%s: Alive = %t, want %t", tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,90 @@
+// Package sysctl changes kernel settings through /proc/sys and remembers the
+// original values so they can be restored on exit.
+package sysctl
+
+import (
+	"encoding/json"
+	"os"
+	"strings"
+
+	"github.com/daniellavrushin/b4/log"
+)
+
+type Setting struct {
+	Name    string
+	Desired string
+	Revert  string
+}
+
+// Conntrack are the settings both firewall backends need: conntrack must
+// not drop the deliberately broken fakes or the out-of-window segments.
+var Conntrack = []Setting{
+	{Name: "net.netfilter.nf_conntrack_checksum", Desired: "0", Revert: "1"},
+	{Name: "net.netfilter.nf_conntrack_tcp_be_liberal", Desired: "1", Revert: "0"},
+}
+
+// SnapshotPath is where the original values are kept until they are
+// reverted. Commands point it into --state-dir with state.SysctlSnapshot so
+// it survives a crash; the default is that file in the default state dir.
+var SnapshotPath = "/var/run/b4/sysctl.json"
+
+func procPath(name string) string {
+	return "/proc/sys/" + strings.ReplaceAll(name, ".", "/")
+}
+
+// Get reads a sysctl by its dotted name.
+func Get(name string) (string, error) {
+	b, err := os.ReadFile(procPath(name))
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(b)), nil
+}
+
+// Set writes a sysctl by its dotted name.
+func Set(name, val string) error {
+	return os.WriteFile(procPath(name), []byte(val+"\n"), 0644)
+}
+
+func loadSnapshot() map[string]string {
+	b, err := os.ReadFile(SnapshotPath)
+	if err != nil {
+		return map[string]string{}
+	}
+	var m map[string]string
+	if json.Unmarshal(b, &m) != nil {
+		return map[string]string{}
+	}
+	return m
+}
+
+func saveSnapshot(m map[string]string) {
+	b, _ := json.Marshal(m)
+	_ = os.WriteFile(SnapshotPath, b, 0600)
+}
+
+func (s Setting) Apply() {
+	snap := loadSnapshot()
+	if _, ok := snap[s.Name]; !ok {
+		if v, err := Get(s.Name); err == nil {
+			snap[s.Name] = v
+			saveSnapshot(snap)
+		}
+	}
+	if err := Set(s.Name, s.Desired); err != nil {
+		log.Errorf("sysctl %s=%s: %v", s.Name, s.Desired, err)
+	}
+}
+
+func (s Setting) RevertBack() {
+	snap := loadSnapshot()
+	val := s.Revert
+	if v, ok := snap[s.Name]; ok && v != "" {
+		val = v
+		delete(snap, s.Name)
+		saveSnapshot(snap)
+	}
+	if err := Set(s.Name, val); err != nil {
+		log.Errorf("sysctl %s=%s: %v", s.Name, val, err)
+	}
+}
@@ -0,0 +1,144 @@
+package tlshello
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Markers a Position can be relative to.
+const (
+	MarkSNI     = "sni"      // first byte of the host name
+	MarkMidSNI  = "midsni"   // middle of the host name
+	MarkHostEnd = "host_end" // just past the host name
+	MarkSNIExt  = "sniext"   // type field of the server_name extension
+)
+
+// Position is a byte offset in a record stream holding a ClientHello: Delta
+// bytes from a marker, or without one from the start of the input, or from
+// its end when Delta is negative.
+type Position struct {
+	Marker string
+	Delta  int
+}
+
+// ParsePosition reads "1", "-10", "sni+1", "midsni" or "sniext-2".
+func ParsePosition(s string) (Position, error) {
+	s = strings.TrimSpace(s)
+	marker, delta := s, ""
+	if i := strings.LastIndexAny(s, "+-"); i >= 0 {
+		marker, delta = s[:i], s[i:]
+	}
+	if marker == "" || marker[0] >= '0' && marker[0] <= '9' {
+		n, err := strconv.Atoi(s)
+		if err != nil || n == 0 {
+			return Position{}, fmt.Errorf("invalid position %q", s)
+		}
+		return Position{Delta: n}, nil
+	}
+	switch marker {
+	case MarkSNI, MarkMidSNI, MarkHostEnd, MarkSNIExt:
+	default:
+		return Position{}, fmt.Errorf("position %q: unknown marker %q", s, marker)
+	}
+	p := Position{Marker: marker}
+	if delta != "" {
+		n, err := strconv.Atoi(delta)
+		if err != nil {
+			return Position{}, fmt.Errorf("invalid position %q", s)
+		}
+		p.Delta = n
+	}
+	return p, nil
+}
+
+func (p Position) String() string {
+	switch {
+	case p.Marker == "":
+		return strconv.Itoa(p.Delta)
+	case p.Delta == 0:
+		return p.Marker
+	}
+	return fmt.Sprintf("%s%+d", p.Marker, p.Delta)
+}
+
+// Resolve returns the offset p stands for in the n byte input h was parsed
+// from. Marker offsets count handshake bytes, skipping the headers of the
+// records the hello is split into. It reports false when the marker is
+// missing from h or the offset does not fall strictly inside the input.
+func (p Position) Resolve(h *ClientHello, n int) (int, bool) {
+	var m int
+	switch p.Marker {
+	case "":
+		off := p.Delta
+		if off < 0 {
+			off += n
+		}
+		return off, off > 0 && off < n
+	case MarkSNIExt:
+		e, ok := h.Ext(ExtServerName)
+		if !ok {
+			return 0, false
+		}
+		m = h.MsgOffset(e.Off)
+	default:
+		if h.SNILen == 0 {
+			return 0, false
+		}
+		m = h.MsgOffset(h.SNIOff)
+		switch p.Marker {
+		case MarkMidSNI:
+			m += h.SNILen / 2
+		case MarkHostEnd:
+			m += h.SNILen
+		}
+	}
+	off := h.Offset(m + p.Delta)
+	return off, off > 0 && off < n
+}
+
+// Positions is a list of positions written as "1,sni+1,-10".
+type Positions []Position
+
+func (ps Positions) String() string {
+	parts := make([]string, len(ps))
+	for i, p := range ps {
+		parts[i] = p.String()
+	}
+	return strings.Join(parts, ",")
+}
+
+// Set implements flag.Value; an empty value clears the list.
+func (ps *Positions) Set(v string) error {
+	var out Positions
+	for _, f := range strings.Split(v, ",") {
+		if strings.TrimSpace(f) == "" {
+			continue
+		}
+		p, err := ParsePosition(f)
+		if err != nil {
+			return err
+		}
+		out = append(out, p)
+	}
+	*ps = out
+	return nil
+}
+
+func (ps Positions) MarshalJSON() ([]byte, error) {
+	return json.Marshal(ps.String())
+}
+
+// UnmarshalJSON accepts "1,midsni" as well as a bare number.
+func (ps *Positions) UnmarshalJSON(b []byte) error {
+	var v string
+	if err := json.Unmarshal(b, &v); err != nil {
+		var n json.Number
+		if json.Unmarshal(b, &n) != nil {
+			return err
+		}
+		v = n.String()
+	}
+	return ps.Set(v)
+}
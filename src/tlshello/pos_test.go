@@ -0,0 +1,68 @@
+package tlshello
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestParsePosition(t *testing.T) {
+	for _, s := range []string{"1", "-10", "sni", "sni+1", "midsni-2", "host_end", "sniext+4"} {
+		p, err := ParsePosition(s)
+		if err != nil {
+			t.Errorf("ParsePosition(%q): %v", s, err)
+			continue
+		}
+		if p.String() != s {
+			t.Errorf("ParsePosition(%q) = %q", s, p)
+		}
+	}
+	for _, s := range []string{"", "0", "sni+", "host", "1x"} {
+		if _, err := ParsePosition(s); err == nil {
+			t.Errorf("ParsePosition(%q) succeeded", s)
+		}
+	}
+}
+
+func TestResolve(t *testing.T) {
+	const host = "example.com"
+	msg := message(sniExt(host))
+	sniAt := bytes.Index(msg, []byte(host))
+
+	for _, in := range [][]byte{records(msg), records(msg, sniAt+4), records(msg, sniAt-3)} {
+		h, err := ParseRecords(in)
+		if err != nil {
+			t.Fatal(err)
+		}
+		at := func(s string) int {
+			p, err := ParsePosition(s)
+			if err != nil {
+				t.Fatal(err)
+			}
+			off, ok := p.Resolve(h, len(in))
+			if !ok {
+				t.Fatalf("%s: not resolved", s)
+			}
+			return off
+		}
+		for _, tt := range []struct {
+			pos  string
+			want byte
+		}{
+			{"sni", 'e'},
+			{"sni+1", 'x'},
+			{"midsni", 'l'},
+			{"host_end-1", 'm'},
+			{"sniext-3", 0}, // null compression
+		} {
+			if got := in[at(tt.pos)]; got != tt.want {
+				t.Errorf("%d records: %s points at %q, want %q", len(h.Records), tt.pos, got, tt.want)
+			}
+		}
+		if got := at("sniext"); in[got] != 0 || in[got+1] != 0 || got != h.Extensions[0].Off {
+			t.Errorf("%d records: sniext at %d, extension at %d", len(h.Records), got, h.Extensions[0].Off)
+		}
+		if got := at("-1"); got != len(in)-1 {
+			t.Errorf("-1 resolved to %d of %d", got, len(in))
+		}
+	}
+}
@@ -0,0 +1,361 @@
+// Package tlshello parses TLS ClientHello messages from a TCP record stream
+// or a QUIC CRYPTO stream and reports where each interesting field lives in
+// the input, so callers can both match on the SNI and split around it.
+package tlshello
+
+import "errors"
+
+const (
+	ContentTypeHandshake = 0x16
+	TypeClientHello      = 0x01
+
+	ExtServerName = 0x0000
+	ExtALPN       = 0x0010
+)
+
+// recordHeaderLen is the size of the TLS record header (type, version, length).
+const recordHeaderLen = 5
+
+var (
+	ErrNotClientHello = errors.New("tlshello: not a ClientHello")
+	ErrMalformed      = errors.New("tlshello: malformed ClientHello")
+)
+
+// Record is a TLS record that carries (part of) the ClientHello.
+type Record struct {
+	Off int // offset of the record header in the input
+	Len int // payload length from the record header
+}
+
+// Extension locates one ClientHello extension.
+type Extension struct {
+	Type uint16
+	Off  int // offset of the extension type field in the input
+	Len  int // length of the extension data
+}
+
+// ClientHello is a parsed view of a ClientHello. All offsets are relative to
+// the slice passed to ParseRecords or ParseHandshake. When the input ends
+// before the message does, Truncated is set and only the fields that were
+// fully present are filled in.
+type ClientHello struct {
+	Records []Record // empty for ParseHandshake
+	Off     int      // offset of the handshake header
+	Len     int      // declared handshake body length
+	End     int      // offset just past the last parsed byte of the message
+
+	Truncated bool
+
+	SNI    string
+	SNIOff int // offset of the host name bytes
+	SNILen int
+
+	ALPN       []string
+	ECH        bool
+	Extensions []Extension
+}
+
+// Ext returns the first extension of the given type.
+func (h *ClientHello) Ext(typ uint16) (Extension, bool) {
+	for _, e := range h.Extensions {
+		if e.Type == typ {
+			return e, true
+		}
+	}
+	return Extension{}, false
+}
+
+// Offset maps m, an offset into the handshake message counted from its
+// header, to the input. Record headers in between are skipped; an offset at
+// a record boundary maps to the start of the next record's payload.
+func (h *ClientHello) Offset(m int) int {
+	if len(h.Records) == 0 {
+		return h.Off + m
+	}
+	return recordOffset(h.Records, m)
+}
+
+// MsgOffset is the inverse of Offset for an input offset inside a record
+// payload.
+func (h *ClientHello) MsgOffset(off int) int {
+	if len(h.Records) == 0 {
+		return off - h.Off
+	}
+	m := 0
+	for i, r := range h.Records {
+		body := r.Off + recordHeaderLen
+		if off < body+r.Len || i == len(h.Records)-1 {
+			return m + off - body
+		}
+		m += r.Len
+	}
+	return m
+}
+
+// HostOffset returns the input offset of byte i of the host name, which
+// may sit in a later record than its first byte.
+func (h *ClientHello) HostOffset(i int) int {
+	return h.Offset(h.MsgOffset(h.SNIOff) + i)
+}
+
+// FindRecord returns the offset of the first TLS handshake record whose
+// payload starts with a ClientHello header.
+func FindRecord(b []byte) (int, bool) {
+	for i := 0; i+recordHeaderLen < len(b); i++ {
+		if b[i] == ContentTypeHandshake && b[i+1] == 0x03 && b[i+recordHeaderLen] == TypeClientHello {
+			return i, true
+		}
+	}
+	return 0, false
+}
+
+// ParseRecords parses a ClientHello from a TLS record stream, starting at
+// the first record found by FindRecord. A ClientHello fragmented over
+// several handshake records is reassembled.
+func ParseRecords(b []byte) (*ClientHello, error) {
+	start, ok := FindRecord(b)
+	if !ok {
+		return nil, ErrNotClientHello
+	}
+	var (
+		recs []Record
+		hs   []byte
+	)
+	for i := start; i+recordHeaderLen <= len(b) && b[i] == ContentTypeHandshake; {
+		l := int(b[i+3])<<8 | int(b[i+4])
+		recs = append(recs, Record{Off: i, Len: l})
+		end := i + recordHeaderLen + l
+		if end > len(b) {
+			end = len(b)
+		}
+		if len(recs) == 1 {
+			hs = b[i+recordHeaderLen : end]
+		} else {
+			if len(recs) == 2 {
+				hs = append([]byte(nil), hs...)
+			}
+			hs = append(hs, b[i+recordHeaderLen:end]...)
+		}
+		if end == len(b) || messageComplete(hs) {
+			break
+		}
+		i = end
+	}
+	h, err := parseMessage(hs)
+	if err != nil {
+		return nil, err
+	}
+	h.Records = recs
+	h.remap(func(off int) int { return recordOffset(recs, off) })
+	return h, nil
+}
+
+// ParseHandshake parses the first ClientHello in a sequence of handshake
+// messages, as carried in QUIC CRYPTO frames.
+func ParseHandshake(b []byte) (*ClientHello, error) {
+	for i := 0; i+4 <= len(b); {
+		n := int(b[i+1])<<16 | int(b[i+2])<<8 | int(b[i+3])
+		if b[i] == TypeClientHello {
+			h, err := parseMessage(b[i:])
+			if err != nil {
+				return nil, err
+			}
+			h.remap(func(off int) int { return off + i })
+			return h, nil
+		}
+		i += 4 + n
+	}
+	return nil, ErrNotClientHello
+}
+
+func messageComplete(hs []byte) bool {
+	if len(hs) < 4 {
+		return false
+	}
+	n := int(hs[1])<<16 | int(hs[2])<<8 | int(hs[3])
+	return len(hs) >= 4+n
+}
+
+// recordOffset maps an offset in the reassembled handshake stream back to
+// the record stream.
+func recordOffset(recs []Record, off int) int {
+	for i, r := range recs {
+		if off < r.Len || i == len(recs)-1 {
+			return r.Off + recordHeaderLen + off
+		}
+		off -= r.Len
+	}
+	return off
+}
+
+func (h *ClientHello) remap(f func(int) int) {
+	h.Off = f(h.Off)
+	h.End = f(h.End-1) + 1
+	if h.SNILen > 0 {
+		h.SNIOff = f(h.SNIOff)
+	}
+	for i := range h.Extensions {
+		h.Extensions[i].Off = f(h.Extensions[i].Off)
+	}
+}
+
+// parseMessage parses a ClientHello handshake message starting at its 4-byte
+// header. Offsets in the result are relative to hs.
+func parseMessage(hs []byte) (*ClientHello, error) {
+	if len(hs) < 4 || hs[0] != TypeClientHello {
+		return nil, ErrNotClientHello
+	}
+	n := int(hs[1])<<16 | int(hs[2])<<8 | int(hs[3])
+	h := &ClientHello{Len: n}
+	end := 4 + n
+	if end > len(hs) {
+		end = len(hs)
+		h.Truncated = true
+	}
+	r := reader{b: hs[:end], p: 4}
+	h.End = 4
+	defer func() { h.End = r.p }()
+
+	// legacy_version, random
+	if !r.skip(2 + 32) {
+		return h.short()
+	}
+	// legacy_session_id, cipher_suites, legacy_compression_methods
+	if !r.skipVec(1) || !r.skipVec(2) || !r.skipVec(1) {
+		return h.short()
+	}
+	if r.p == len(r.b) && !h.Truncated {
+		// No extensions at all; legal for TLS 1.2 and below.
+		return h, nil
+	}
+	extLen, ok := r.u16()
+	if !ok {
+		return h.short()
+	}
+	extEnd := r.p + extLen
+	if extEnd > len(r.b) {
+		if !h.Truncated {
+			return nil, ErrMalformed
+		}
+		extEnd = len(r.b)
+	}
+	for r.p+4 <= extEnd {
+		off := r.p
+		typ, _ := r.u16()
+		l, _ := r.u16()
+		if r.p+l > extEnd {
+			r.p = off
+			return h.short()
+		}
+		data := r.b[r.p : r.p+l]
+		h.Extensions = append(h.Extensions, Extension{Type: uint16(typ), Off: off, Len: l})
+		switch {
+		case typ == ExtServerName:
+			if name, at, ok := parseServerName(data); ok {
+				h.SNI = string(name)
+				h.SNIOff = r.p + at
+				h.SNILen = len(name)
+			}
+		case typ == ExtALPN:
+			h.ALPN = parseALPN(data)
+		case typ == 0xfe0d || typ == 0xfe0e || typ == 0xfe0f:
+			h.ECH = true
+		}
+		r.p += l
+	}
+	if r.p != extEnd && !h.Truncated {
+		return nil, ErrMalformed
+	}
+	return h, nil
+}
+
+// short reports running out of input: expected when the message is
+// truncated, malformed otherwise.
+func (h *ClientHello) short() (*ClientHello, error) {
+	if h.Truncated {
+		return h, nil
+	}
+	return nil, ErrMalformed
+}
+
+// parseServerName returns the first host_name entry of a server_name
+// extension and its offset within the extension data.
+func parseServerName(d []byte) ([]byte, int, bool) {
+	r := reader{b: d}
+	listLen, ok := r.u16()
+	if !ok || r.p+listLen > len(d) {
+		return nil, 0, false
+	}
+	end := r.p + listLen
+	for r.p+3 <= end {
+		typ := d[r.p]
+		r.p++
+		l, _ := r.u16()
+		if r.p+l > end {
+			return nil, 0, false
+		}
+		if typ == 0 && l > 0 {
+			return d[r.p : r.p+l], r.p, true
+		}
+		r.p += l
+	}
+	return nil, 0, false
+}
+
+func parseALPN(d []byte) []string {
+	r := reader{b: d}
+	listLen, ok := r.u16()
+	if !ok || r.p+listLen > len(d) {
+		return nil
+	}
+	end := r.p + listLen
+	var out []string
+	for r.p < end {
+		l := int(d[r.p])
+		r.p++
+		if r.p+l > end {
+			break
+		}
+		out = append(out, string(d[r.p:r.p+l]))
+		r.p += l
+	}
+	return out
+}
+
+type reader struct {
+	b []byte
+	p int
+}
+
+func (r *reader) skip(n int) bool {
+	if r.p+n > len(r.b) {
+		return false
+	}
+	r.p += n
+	return true
+}
+
+func (r *reader) u16() (int, bool) {
+	if r.p+2 > len(r.b) {
+		return 0, false
+	}
+	v := int(r.b[r.p])<<8 | int(r.b[r.p+1])
+	r.p += 2
+	return v, true
+}
+
+// skipVec skips a vector with a lenBytes-wide length prefix.
+func (r *reader) skipVec(lenBytes int) bool {
+	if r.p+lenBytes > len(r.b) {
+		return false
+	}
+	n := 0
+	for i := 0; i < lenBytes; i++ {
+		n = n<<8 | int(r.b[r.p+i])
+	}
+	if r.p+lenBytes+n > len(r.b) {
+		return false
+	}
+	r.p += lenBytes + n
+	return true
+}
@@ -0,0 +1,188 @@
+package tlshello
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"slices"
+	"testing"
+)
+
+func ext(typ uint16, data []byte) []byte {
+	b := binary.BigEndian.AppendUint16(nil, typ)
+	b = binary.BigEndian.AppendUint16(b, uint16(len(data)))
+	return append(b, data...)
+}
+
+func sniExt(host string) []byte {
+	d := binary.BigEndian.AppendUint16(nil, uint16(len(host)+3))
+	d = append(d, 0)
+	d = binary.BigEndian.AppendUint16(d, uint16(len(host)))
+	return ext(ExtServerName, append(d, host...))
+}
+
+func alpnExt(protos ...string) []byte {
+	var l []byte
+	for _, p := range protos {
+		l = append(l, byte(len(p)))
+		l = append(l, p...)
+	}
+	return ext(ExtALPN, append(binary.BigEndian.AppendUint16(nil, uint16(len(l))), l...))
+}
+
+// message builds a ClientHello handshake message; without extensions the
+// extensions block is left out entirely.
+func message(exts ...[]byte) []byte {
+	body := []byte{3, 3}
+	body = append(body, make([]byte, 32)...)    // random
+	body = append(body, 0)                      // session ID
+	body = append(body, 0, 2, 0x13, 0x01, 1, 0) // one suite, null compression
+	if len(exts) > 0 {
+		all := slices.Concat(exts...)
+		body = binary.BigEndian.AppendUint16(body, uint16(len(all)))
+		body = append(body, all...)
+	}
+	n := len(body)
+	return append([]byte{TypeClientHello, byte(n >> 16), byte(n >> 8), byte(n)}, body...)
+}
+
+// records wraps msg in handshake records, cutting it at the given offsets.
+func records(msg []byte, cuts ...int) []byte {
+	var out []byte
+	prev := 0
+	for _, c := range append(cuts, len(msg)) {
+		out = append(out, ContentTypeHandshake, 3, 1, byte((c-prev)>>8), byte(c-prev))
+		out = append(out, msg[prev:c]...)
+		prev = c
+	}
+	return out
+}
+
+func TestParse(t *testing.T) {
+	full := message(sniExt("example.com"), alpnExt("h2", "http/1.1"))
+	sniAt := bytes.Index(full, []byte("example.com"))
+
+	tests := []struct {
+		name      string
+		in        []byte
+		handshake bool
+		err       error
+		sni       string
+		alpn      []string
+		ech       bool
+		truncated bool
+		records   []Record
+	}{
+		{
+			name:    "single record",
+			in:      records(full),
+			sni:     "example.com",
+			alpn:    []string{"h2", "http/1.1"},
+			records: []Record{{0, len(full)}},
+		},
+		{
+			name:    "fragmented before the extensions",
+			in:      records(full, 20),
+			sni:     "example.com",
+			alpn:    []string{"h2", "http/1.1"},
+			records: []Record{{0, 20}, {25, len(full) - 20}},
+		},
+		{
+			name:    "fragmented inside the host name",
+			in:      records(full, sniAt+4),
+			sni:     "example.com",
+			alpn:    []string{"h2", "http/1.1"},
+			records: []Record{{0, sniAt + 4}, {sniAt + 9, len(full) - sniAt - 4}},
+		},
+		{
+			name:      "truncated after the host name",
+			in:        records(full)[:5+sniAt+len("example.com")+3],
+			sni:       "example.com",
+			truncated: true,
+			records:   []Record{{0, len(full)}},
+		},
+		{
+			name:      "truncated in the random",
+			in:        records(full)[:5+20],
+			truncated: true,
+			records:   []Record{{0, len(full)}},
+		},
+		{
+			name: "extension length past the block",
+			in: func() []byte {
+				m := message(sniExt("example.com"))
+				m[len(m)-len("example.com")-6]++ // low byte of the server_name extension length
+				return records(m)
+			}(),
+			err: ErrMalformed,
+		},
+		{
+			name:    "no extensions",
+			in:      records(message()),
+			records: []Record{{0, len(message())}},
+		},
+		{
+			name:    "ECH",
+			in:      records(message(sniExt("public.example"), ext(0xfe0d, []byte{0, 1, 2}))),
+			sni:     "public.example",
+			ech:     true,
+			records: []Record{{0, len(message(sniExt("public.example"), ext(0xfe0d, []byte{0, 1, 2})))}},
+		},
+		{
+			name: "not a ClientHello",
+			in:   []byte{0x17, 3, 3, 0, 2, 1, 2},
+			err:  ErrNotClientHello,
+		},
+		{
+			name:      "QUIC CRYPTO",
+			in:        full,
+			handshake: true,
+			sni:       "example.com",
+			alpn:      []string{"h2", "http/1.1"},
+		},
+		{
+			name:      "QUIC CRYPTO after another message",
+			in:        append([]byte{0x0b, 0, 0, 2, 9, 9}, full...),
+			handshake: true,
+			sni:       "example.com",
+			alpn:      []string{"h2", "http/1.1"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			parse := ParseRecords
+			if tt.handshake {
+				parse = ParseHandshake
+			}
+			h, err := parse(tt.in)
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("err = %v, want %v", err, tt.err)
+			}
+			if err != nil {
+				return
+			}
+			if h.SNI != tt.sni || h.ECH != tt.ech || h.Truncated != tt.truncated {
+				t.Errorf("SNI %q ECH %t truncated %t, want %q %t %t", h.SNI, h.ECH, h.Truncated, tt.sni, tt.ech, tt.truncated)
+			}
+			if !slices.Equal(h.ALPN, tt.alpn) {
+				t.Errorf("ALPN %q, want %q", h.ALPN, tt.alpn)
+			}
+			if !slices.Equal(h.Records, tt.records) {
+				t.Errorf("records %v, want %v", h.Records, tt.records)
+			}
+			if tt.in[h.Off] != TypeClientHello {
+				t.Errorf("Off %d does not point at the handshake header", h.Off)
+			}
+			for i := range h.SNILen {
+				if off := h.HostOffset(i); tt.in[off] != h.SNI[i] {
+					t.Errorf("HostOffset(%d) = %d points at %q", i, off, tt.in[off])
+				}
+			}
+			for _, e := range h.Extensions {
+				if got := binary.BigEndian.Uint16(tt.in[e.Off:]); got != e.Type {
+					t.Errorf("extension %#x: Off %d points at %#x", e.Type, e.Off, got)
+				}
+			}
+		})
+	}
+}